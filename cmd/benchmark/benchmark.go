@@ -58,7 +58,7 @@ func main() {
 			}
 
 			d := xclient.NewGeeRegistryDiscovery(registryAddr, 0)
-			client := xclient.NewXClient(d, xclient.RandomSelect, opt)
+			client := xclient.NewXClient(d, xclient.RandomSelect, xclient.Failfast, opt)
 			defer client.Close()
 
 			for ctx.Err() == nil {
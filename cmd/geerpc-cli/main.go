@@ -0,0 +1,234 @@
+// geerpc-cli talks to a GeeRPC server from the command line:
+//
+//	geerpc-cli -addr tcp@localhost:9999 list
+//	geerpc-cli -addr tcp@localhost:9999 describe CalcService.Add
+//	geerpc-cli -registry http://localhost:8001/geerpc/demo_registry call CalcService.Add '{"A":1,"B":2}'
+//
+// Services and schemas come from the built-in Reflection service,
+// calls use the JSON codec so args and replies are plain JSON.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"geerpc/codec"
+	"geerpc/geerpc"
+	"geerpc/xclient"
+)
+
+var (
+	addr     = flag.String("addr", "", "server address, protocol@addr, e.g. tcp@localhost:9999, http@localhost:9999, unix@/tmp/geerpc.sock")
+	registry = flag.String("registry", "", "registry URL, a server is picked from it when -addr isn't set")
+	timeout  = flag.Duration("timeout", 10*time.Second, "timeout of the whole command")
+	verbose  = flag.Bool("v", false, "keep the logs of the rpc library")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: geerpc-cli [flags] <command>
+
+commands:
+  list                           list services and methods
+  describe <Service.Method>      print the argument and reply schema of a method
+  call <Service.Method> [args]   call a method with JSON args, read from stdin when omitted
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+// errUsage reports a wrong command line, the usage is printed instead.
+var errUsage = errors.New("usage")
+
+// command is a parsed command line.
+type command struct {
+	name          string // list, describe or call
+	serviceMethod string
+	input         []byte // JSON args of call
+}
+
+func main() {
+	os.Exit(runMain())
+}
+
+// runMain runs the command and returns the exit code, so that deferred calls run.
+func runMain() int {
+	flag.Usage = usage
+	flag.Parse()
+	cmd, err := parseCommand(flag.Args(), os.Stdin)
+	if err == errUsage {
+		usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "geerpc-cli:", err)
+		return 1
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if err := run(ctx, *addr, *registry, cmd, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "geerpc-cli:", err)
+		return 1
+	}
+	return 0
+}
+
+// parseCommand checks the command and its arguments before anything is dialed,
+// the args of call are read from stdin when omitted.
+func parseCommand(args []string, stdin io.Reader) (command, error) {
+	if len(args) == 0 {
+		return command{}, errUsage
+	}
+	cmd := command{name: args[0]}
+	switch {
+	case cmd.name == "list" && len(args) == 1:
+	case cmd.name == "describe" && len(args) == 2:
+		cmd.serviceMethod = args[1]
+	case cmd.name == "call" && (len(args) == 2 || len(args) == 3):
+		cmd.serviceMethod = args[1]
+		if len(args) == 3 {
+			cmd.input = []byte(args[2])
+		} else {
+			var err error
+			if cmd.input, err = io.ReadAll(stdin); err != nil {
+				return command{}, err
+			}
+		}
+		cmd.input = bytes.TrimSpace(cmd.input)
+		if !json.Valid(cmd.input) {
+			return command{}, fmt.Errorf("args are not valid JSON: %s", cmd.input)
+		}
+	default:
+		return command{}, errUsage
+	}
+	if cmd.serviceMethod != "" && !strings.Contains(cmd.serviceMethod, ".") {
+		return command{}, fmt.Errorf("%q is not formatted as Service.Method", cmd.serviceMethod)
+	}
+	return cmd, nil
+}
+
+// run connects to rpcAddr, or to a server picked from registryURL, and runs cmd.
+func run(ctx context.Context, rpcAddr, registryURL string, cmd command, out io.Writer) error {
+	client, err := dial(rpcAddr, registryURL)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = client.Close() }()
+
+	switch cmd.name {
+	case "list":
+		return list(ctx, client, out)
+	case "describe":
+		return describe(ctx, client, cmd.serviceMethod, out)
+	default:
+		return call(ctx, client, cmd.serviceMethod, cmd.input, out)
+	}
+}
+
+// dial connects to rpcAddr, or to a server picked from registryURL.
+func dial(rpcAddr, registryURL string) (*geerpc.Client, error) {
+	if rpcAddr == "" {
+		if registryURL == "" {
+			return nil, fmt.Errorf("either -addr or -registry is required")
+		}
+		d := xclient.NewGeeRegistryDiscovery(registryURL, 0)
+		var err error
+		if rpcAddr, err = d.Get(xclient.RandomSelect); err != nil {
+			return nil, err
+		}
+	}
+	return geerpc.XDial(rpcAddr, &geerpc.Option{
+		CodecType:      codec.JsonType,
+		ConnectTimeout: *timeout,
+	})
+}
+
+func list(ctx context.Context, client *geerpc.Client, out io.Writer) error {
+	var reply geerpc.ListServicesReply
+	if err := client.Call(ctx, "Reflection.ListServices", geerpc.ListServicesArgs{}, &reply); err != nil {
+		return err
+	}
+	for _, svc := range reply.Services {
+		fmt.Fprintln(out, svc.Name)
+		for _, m := range svc.Methods {
+			fmt.Fprintf(out, "  %s.%s(%s, %s) error", svc.Name, m.Name, m.ArgType.Name, m.ReplyType.Name)
+			if m.Options.Deprecated != "" {
+				fmt.Fprintf(out, " // deprecated: %s", m.Options.Deprecated)
+			}
+			fmt.Fprintln(out)
+		}
+	}
+	return nil
+}
+
+func describe(ctx context.Context, client *geerpc.Client, serviceMethod string, out io.Writer) error {
+	var m geerpc.MethodDesc
+	args := geerpc.DescribeMethodArgs{ServiceMethod: serviceMethod}
+	if err := client.Call(ctx, "Reflection.DescribeMethod", args, &m); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s(%s, %s) error\n\n", serviceMethod, m.ArgType.Name, m.ReplyType.Name)
+	fmt.Fprintf(out, "args, e.g. %s\n\n", example(m.ArgType))
+	schema, err := json.MarshalIndent(&m, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, string(schema))
+	return nil
+}
+
+func call(ctx context.Context, client *geerpc.Client, serviceMethod string, input []byte, out io.Writer) error {
+	var reply json.RawMessage
+	if err := client.Call(ctx, serviceMethod, json.RawMessage(input), &reply); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, reply, "", "  "); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, buf.String())
+	return nil
+}
+
+// example returns a JSON value of the type described by d, with zero values.
+func example(d *geerpc.TypeDesc) string {
+	if d == nil {
+		return "null"
+	}
+	switch d.Kind {
+	case "ptr":
+		return example(d.Elem)
+	case "struct":
+		fields := make([]string, 0, len(d.Fields))
+		for _, f := range d.Fields {
+			fields = append(fields, fmt.Sprintf("%q:%s", f.Name, example(f.Type)))
+		}
+		return "{" + strings.Join(fields, ",") + "}"
+	case "slice", "array":
+		return "[]"
+	case "map":
+		return "{}"
+	case "string":
+		return `""`
+	case "bool":
+		return "false"
+	case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64",
+		"uintptr", "float32", "float64":
+		return "0"
+	default:
+		return "null"
+	}
+}
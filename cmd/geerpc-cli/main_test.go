@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"geerpc/geerpc"
+	"net"
+	"strings"
+	"testing"
+)
+
+type Arith int
+
+type Args struct{ A, B int }
+
+func (a Arith) Add(args Args, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	t.Parallel()
+	for _, args := range [][]string{nil, {"list", "x"}, {"describe"}, {"call"}, {"remove", "x"}} {
+		_, err := parseCommand(args, strings.NewReader(""))
+		_assert(err == errUsage, "expect a usage error for %v, got %v", args, err)
+	}
+	_, err := parseCommand([]string{"call", "Arith.Add", "{"}, nil)
+	_assert(err != nil && strings.Contains(err.Error(), "JSON"), "expect invalid JSON to be refused, got %v", err)
+	_, err = parseCommand([]string{"describe", "Add"}, nil)
+	_assert(err != nil && strings.Contains(err.Error(), "Service.Method"), "expect a method without service to be refused, got %v", err)
+	cmd, err := parseCommand([]string{"call", "Arith.Add"}, strings.NewReader(` {"A":1} `+"\n"))
+	_assert(err == nil && string(cmd.input) == `{"A":1}`, "expect args from stdin, got %q %v", cmd.input, err)
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+	server := geerpc.NewServer()
+	_ = server.Register(new(Arith))
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	addr := "tcp@" + l.Addr().String()
+	ctx := context.Background()
+
+	var out bytes.Buffer
+	_assert(run(ctx, addr, "", command{name: "list"}, &out) == nil, "failed to list")
+	_assert(strings.Contains(out.String(), "Arith.Add(main.Args, *int) error"), "expect Arith.Add to be listed, got %s", out.String())
+
+	out.Reset()
+	_assert(run(ctx, addr, "", command{name: "describe", serviceMethod: "Arith.Add"}, &out) == nil, "failed to describe")
+	_assert(strings.Contains(out.String(), `args, e.g. {"A":0,"B":0}`), "expect an example of the args, got %s", out.String())
+
+	out.Reset()
+	cmd := command{name: "call", serviceMethod: "Arith.Add", input: []byte(`{"A":1,"B":2}`)}
+	_assert(run(ctx, addr, "", cmd, &out) == nil && strings.TrimSpace(out.String()) == "3", "expect 3, got %s", out.String())
+
+	err := run(ctx, "", "", command{name: "list"}, &out)
+	_assert(err != nil && strings.Contains(err.Error(), "-addr"), "expect an address to be required, got %v", err)
+}
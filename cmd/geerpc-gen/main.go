@@ -0,0 +1,318 @@
+// geerpc-gen reads the Go package in a directory and generates typed client
+// stubs and registration helpers for its services, so that a typo in a
+// "Service.Method" string becomes a compile error:
+//
+//	//go:generate go run geerpc/cmd/geerpc-gen -type CalcService
+//
+// generates
+//
+//	calc := NewCalcServiceClient(client) // *geerpc.Client or *xclient.XClient
+//	sum, err := calc.Add(ctx, &CArgs{A: 1, B: 2})
+//	err = RegisterCalcService(server, &CalcService{})
+//
+// A service is an exported type with at least one method of the form
+// "func (t *T) MethodName(argType T1, replyType *T2) error".
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var (
+	dir        = flag.String("dir", ".", "directory of the package containing the services")
+	typeNames  = flag.String("type", "", "comma-separated service types, empty means every service found")
+	output     = flag.String("o", "geerpc_gen.go", "output file, relative to -dir")
+	geerpcPath = flag.String("geerpc", "geerpc/geerpc", "import path of the geerpc package")
+)
+
+type method struct {
+	Name      string
+	ArgType   string // as written in the source
+	ReplyType string // the type pointed to by the reply parameter
+}
+
+type service struct {
+	Name    string
+	Pointer bool // methods have pointer receivers
+	Methods []method
+}
+
+type file struct {
+	Package  string
+	Geerpc   string
+	Imports  []string
+	Services []*service
+}
+
+const stubTemplate = `// Code generated by geerpc-gen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+{{range .Imports}}	{{.}}
+{{end}}
+	"{{.Geerpc}}"
+)
+{{range $svc := .Services}}
+// {{.Name}}Client is a typed client of the {{.Name}} service, it calls through
+// a *geerpc.Client or a *xclient.XClient.
+type {{.Name}}Client struct {
+	c geerpc.Caller
+}
+
+func New{{.Name}}Client(c geerpc.Caller) *{{.Name}}Client {
+	return &{{.Name}}Client{c: c}
+}
+{{range .Methods}}
+// {{.Name}} calls {{$svc.Name}}.{{.Name}}.
+func (c *{{$svc.Name}}Client) {{.Name}}(ctx context.Context, args {{.ArgType}}) ({{.ReplyType}}, error) {
+	var reply {{.ReplyType}}
+	err := c.c.Call(ctx, "{{$svc.Name}}.{{.Name}}", args, &reply)
+	return reply, err
+}
+{{end}}
+// Register{{.Name}} registers svc as the {{.Name}} service of server.
+func Register{{.Name}}(server *geerpc.Server, svc {{if .Pointer}}*{{end}}{{.Name}}) error {
+	return server.Register(svc)
+}
+{{end}}`
+
+var stubs = template.Must(template.New("stubs").Parse(stubTemplate))
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("geerpc-gen: ")
+	flag.Parse()
+
+	var wanted []string
+	if *typeNames != "" {
+		wanted = strings.Split(*typeNames, ",")
+	}
+	src, err := generate(*dir, *output, wanted, *geerpcPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(*dir, *output), src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generate returns the stubs of the wanted services of the package in dir,
+// empty wanted means every service found.
+func generate(dir, output string, wanted []string, geerpcPath string) ([]byte, error) {
+	pkg, files, err := parsePackage(dir, output)
+	if err != nil {
+		return nil, err
+	}
+	f, err := collect(pkg, files, wanted)
+	if err != nil {
+		return nil, err
+	}
+	f.Geerpc = geerpcPath
+	// geerpc is always imported
+	for i, spec := range f.Imports {
+		if spec == strconv.Quote(geerpcPath) {
+			f.Imports = append(f.Imports[:i], f.Imports[i+1:]...)
+			break
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := stubs.Execute(&buf, f); err != nil {
+		return nil, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format generated code: %v\n%s", err, buf.Bytes())
+	}
+	return src, nil
+}
+
+// parsePackage parses the non-test Go files of dir, skipping the generated file.
+func parsePackage(dir, generated string) (string, []*ast.File, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return "", nil, err
+	}
+	fset := token.NewFileSet()
+	var pkg string
+	var files []*ast.File
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") || filepath.Base(path) == filepath.Base(generated) {
+			continue
+		}
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return "", nil, err
+		}
+		if pkg != "" && f.Name.Name != pkg {
+			return "", nil, fmt.Errorf("found packages %s and %s in %s", pkg, f.Name.Name, dir)
+		}
+		pkg = f.Name.Name
+		files = append(files, f)
+	}
+	if pkg == "" {
+		return "", nil, fmt.Errorf("no Go files in %s", dir)
+	}
+	return pkg, files, nil
+}
+
+// collect finds the services, and the imports their argument and reply types need.
+func collect(pkg string, files []*ast.File, wanted []string) (*file, error) {
+	services := make(map[string]*service)
+	imports := make(map[string]string) // package name -> import spec
+	for _, f := range files {
+		fileImports := importsOf(f)
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil || len(fn.Recv.List) != 1 || !fn.Name.IsExported() {
+				continue
+			}
+			recv, pointer := receiverType(fn.Recv.List[0].Type)
+			if recv == "" || !ast.IsExported(recv) {
+				continue
+			}
+			m, names, ok := methodOf(fn)
+			if !ok {
+				continue
+			}
+			svc := services[recv]
+			if svc == nil {
+				svc = &service{Name: recv}
+				services[recv] = svc
+			}
+			svc.Pointer = svc.Pointer || pointer
+			svc.Methods = append(svc.Methods, m)
+			for _, name := range names {
+				if spec, ok := fileImports[name]; ok {
+					imports[name] = spec
+				}
+			}
+		}
+	}
+
+	f := &file{Package: pkg}
+	if len(wanted) == 0 {
+		for name := range services {
+			wanted = append(wanted, name)
+		}
+		sort.Strings(wanted)
+	}
+	for _, name := range wanted {
+		svc := services[strings.TrimSpace(name)]
+		if svc == nil {
+			return nil, fmt.Errorf("no service %s in package %s", name, pkg)
+		}
+		sort.Slice(svc.Methods, func(i, j int) bool { return svc.Methods[i].Name < svc.Methods[j].Name })
+		f.Services = append(f.Services, svc)
+	}
+	for _, spec := range imports {
+		f.Imports = append(f.Imports, spec)
+	}
+	sort.Strings(f.Imports)
+	return f, nil
+}
+
+// importsOf maps the names of the packages imported by f to their import specs.
+func importsOf(f *ast.File) map[string]string {
+	imports := make(map[string]string)
+	for _, imp := range f.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		name := path[strings.LastIndex(path, "/")+1:]
+		spec := imp.Path.Value
+		if imp.Name != nil {
+			name = imp.Name.Name
+			spec = name + " " + spec
+		}
+		imports[name] = spec
+	}
+	return imports
+}
+
+func receiverType(expr ast.Expr) (name string, pointer bool) {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr, pointer = star.X, true
+	}
+	if ident, ok := expr.(*ast.Ident); ok {
+		return ident.Name, pointer
+	}
+	return "", false
+}
+
+// methodOf checks fn is func (t *T) MethodName(argType T1, replyType *T2) error,
+// and returns the package names used by T1 and T2.
+func methodOf(fn *ast.FuncDecl) (method, []string, bool) {
+	var params []ast.Expr
+	for _, field := range fn.Type.Params.List {
+		n := len(field.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			params = append(params, field.Type)
+		}
+	}
+	results := fn.Type.Results
+	if len(params) != 2 || results == nil || len(results.List) != 1 || len(results.List[0].Names) > 1 {
+		return method{}, nil, false
+	}
+	if ident, ok := results.List[0].Type.(*ast.Ident); !ok || ident.Name != "error" {
+		return method{}, nil, false
+	}
+	reply, ok := params[1].(*ast.StarExpr)
+	if !ok || !exportedOrBuiltin(params[0]) || !exportedOrBuiltin(reply.X) {
+		return method{}, nil, false
+	}
+	var names []string
+	for _, expr := range []ast.Expr{params[0], reply.X} {
+		ast.Inspect(expr, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				if x, ok := sel.X.(*ast.Ident); ok {
+					names = append(names, x.Name)
+				}
+			}
+			return true
+		})
+	}
+	return method{
+		Name:      fn.Name.Name,
+		ArgType:   exprString(params[0]),
+		ReplyType: exprString(reply.X),
+	}, names, true
+}
+
+// exportedOrBuiltin reports whether a stub may name the type: a type named
+// in this package must be exported, also when pointed to like *T, other
+// unnamed types like []T pass.
+func exportedOrBuiltin(expr ast.Expr) bool {
+	for {
+		star, ok := expr.(*ast.StarExpr)
+		if !ok {
+			break
+		}
+		expr = star.X
+	}
+	ident, ok := expr.(*ast.Ident)
+	return !ok || ident.IsExported() || types.Universe.Lookup(ident.Name) != nil
+}
+
+func exprString(expr ast.Expr) string {
+	var buf bytes.Buffer
+	_ = format.Node(&buf, token.NewFileSet(), expr)
+	return buf.String()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+// TestGenerate checks the stubs of the test package match the checked-in ones.
+func TestGenerate(t *testing.T) {
+	t.Parallel()
+	dir := filepath.Join("..", "..", "test")
+	src, err := generate(dir, "calc_geerpc.go", []string{"CalcService"}, "geerpc/geerpc")
+	_assert(err == nil, "failed to generate: %v", err)
+	golden, err := os.ReadFile(filepath.Join(dir, "calc_geerpc.go"))
+	_assert(err == nil, "failed to read the golden file: %v", err)
+	_assert(bytes.Equal(src, golden), "expect the stubs to match calc_geerpc.go, run go generate ./test, got\n%s", src)
+
+	_, err = generate(dir, "calc_geerpc.go", []string{"NoService"}, "geerpc/geerpc")
+	_assert(err != nil, "expect an unknown service to be refused")
+}
+
+func TestMethodOf(t *testing.T) {
+	t.Parallel()
+	f, err := parser.ParseFile(token.NewFileSet(), "svc.go", `package svc
+
+type args struct{}
+type Args struct{}
+
+func (s *S) Ok(args Args, reply *int) error                { return nil }
+func (s *S) PointerArgs(args *Args, reply *[]string) error { return nil }
+func (s *S) HiddenArgs(args *args, reply *int) error       { return nil }
+func (s *S) HiddenReply(args Args, reply *args) error      { return nil }
+func (s *S) HiddenDeep(args Args, reply **args) error      { return nil }
+func (s *S) NoPointer(args Args, reply int) error          { return nil }
+`, 0)
+	_assert(err == nil, "failed to parse: %v", err)
+	services, err := collect("svc", []*ast.File{f}, nil)
+	_assert(err == nil && len(services.Services) == 1, "expect service S, got %v", err)
+	var names []string
+	for _, m := range services.Services[0].Methods {
+		names = append(names, m.Name)
+	}
+	_assert(fmt.Sprint(names) == "[Ok PointerArgs]", "expect only the methods of exported types, got %v", names)
+}
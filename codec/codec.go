@@ -1,6 +1,7 @@
 package codec
 
 import (
+	"errors"
 	"io"
 )
 
@@ -17,6 +18,26 @@ type Codec interface {
 	Write(*Header, interface{}) error
 }
 
+// ErrMessageTooLarge is returned when a message is larger than the limit
+// it's read with, the message is discarded without being decoded.
+var ErrMessageTooLarge = errors.New("rpc codec: message too large")
+
+// Limiter is implemented by codecs which can refuse messages before decoding them.
+type Limiter interface {
+	// SetLimits sets the max sizes in bytes of the headers and bodies read,
+	// 0 means no limit. A header too large can't be skipped safely, as the
+	// body following it is unknown.
+	SetLimits(maxHeader, maxBody int)
+}
+
+// BodyLimiter is implemented by codecs which can refuse a body before decoding it.
+type BodyLimiter interface {
+	// ReadBodyLimit is ReadBody, but fails with ErrMessageTooLarge when the body
+	// is larger than limit bytes, or than the limit set by SetLimits.
+	// The next header can still be read then.
+	ReadBodyLimit(body interface{}, limit int) error
+}
+
 // 定义一种函数类型 工厂函数 (factory function)
 type NewCodecFunc func(io.ReadWriteCloser) Codec
 
@@ -29,6 +50,14 @@ const (
 
 var NewCodecFuncMap map[Type]NewCodecFunc
 
+// minLimit returns the smaller of two limits, 0 meaning no limit.
+func minLimit(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
 func init() {
 	NewCodecFuncMap = make(map[Type]NewCodecFunc)
 	NewCodecFuncMap[GobType] = NewGobCodec
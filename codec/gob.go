@@ -3,6 +3,7 @@ package codec
 import (
 	"bufio"
 	"encoding/gob"
+	"errors"
 	"io"
 	"log"
 )
@@ -10,28 +11,49 @@ import (
 type GobCodec struct {
 	conn io.ReadWriteCloser //  TCP 或者 Unix 建立 socket 时得到的链接实例
 	buf  *bufio.Writer
+	r    *gobFrameReader
 	dec  *gob.Decoder
 	enc  *gob.Encoder
+	// max sizes of the messages read, 0 means no limit
+	maxHeader, maxBody int
 }
 
 var _ Codec = (*GobCodec)(nil)
+var _ Limiter = (*GobCodec)(nil)
+var _ BodyLimiter = (*GobCodec)(nil)
 
 func NewGobCodec(conn io.ReadWriteCloser) Codec {
 	buf := bufio.NewWriter(conn)
+	r := &gobFrameReader{r: bufio.NewReader(conn)}
 	return &GobCodec{
 		conn: conn,
 		buf:  buf,
-		dec:  gob.NewDecoder(conn),
+		r:    r,
+		dec:  gob.NewDecoder(r),
 		enc:  gob.NewEncoder(conn),
 	}
 }
 
+func (c *GobCodec) SetLimits(maxHeader, maxBody int) {
+	c.maxHeader, c.maxBody = maxHeader, maxBody
+}
+
 func (c *GobCodec) ReadHeader(h *Header) error {
-	return c.dec.Decode(h)
+	return c.decode(h, c.maxHeader)
 }
 
 func (c *GobCodec) ReadBody(body interface{}) error {
-	return c.dec.Decode(body)
+	return c.decode(body, c.maxBody)
+}
+
+func (c *GobCodec) ReadBodyLimit(body interface{}, limit int) error {
+	return c.decode(body, minLimit(limit, c.maxBody))
+}
+
+// decode decodes the next value, refusing messages larger than limit.
+func (c *GobCodec) decode(v interface{}, limit int) error {
+	c.r.limit = limit
+	return c.dec.Decode(v)
 }
 
 func (c *GobCodec) Write(h *Header, body interface{}) (err error) {
@@ -56,3 +78,77 @@ func (c *GobCodec) Write(h *Header, body interface{}) (err error) {
 func (c *GobCodec) Close() error {
 	return c.conn.Close()
 }
+
+// gobFrameReader hands the messages of a gob stream to the decoder, and
+// discards those longer than limit instead. A gob message is its length,
+// encoded as a gob uint, followed by that many bytes.
+type gobFrameReader struct {
+	r      *bufio.Reader
+	limit  int   // 0 means no limit
+	remain int64 // bytes of the current message not read yet, its length included
+}
+
+// it's an io.ByteReader, so gob.Decoder doesn't buffer it again
+var _ io.ByteReader = (*gobFrameReader)(nil)
+
+func (f *gobFrameReader) Read(p []byte) (int, error) {
+	if f.remain == 0 {
+		if err := f.next(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > f.remain {
+		p = p[:f.remain]
+	}
+	n, err := f.r.Read(p)
+	f.remain -= int64(n)
+	return n, err
+}
+
+func (f *gobFrameReader) ReadByte() (byte, error) {
+	if f.remain == 0 {
+		if err := f.next(); err != nil {
+			return 0, err
+		}
+	}
+	b, err := f.r.ReadByte()
+	if err == nil {
+		f.remain--
+	}
+	return b, err
+}
+
+// next peeks the length of the next message, and skips the message when it's too large.
+func (f *gobFrameReader) next() error {
+	b, err := f.r.Peek(1)
+	if err != nil {
+		return err
+	}
+	// a uint below 0x80 is one byte, otherwise the byte is the negated
+	// count of the big-endian bytes which follow
+	n, width := uint64(b[0]), 1
+	if b[0] >= 0x80 {
+		width += int(-int8(b[0]))
+		if width > 9 {
+			return errors.New("rpc codec: gob message length is ill-formed")
+		}
+		if b, err = f.r.Peek(width); err != nil {
+			return err
+		}
+		n = 0
+		for _, c := range b[1:] {
+			n = n<<8 | uint64(c)
+		}
+	}
+	if f.limit > 0 && n > uint64(f.limit) {
+		if _, err := f.r.Discard(width); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, f.r, int64(n)); err != nil {
+			return err
+		}
+		return ErrMessageTooLarge
+	}
+	f.remain = int64(width) + int64(n)
+	return nil
+}
@@ -2,6 +2,7 @@ package codec
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"io"
 	"log"
@@ -10,28 +11,83 @@ import (
 type JsonCodec struct {
 	conn io.ReadWriteCloser //  TCP 或者 Unix 建立 socket 时得到的链接实例
 	buf  *bufio.Writer
-	dec  *json.Decoder
+	r    *bufio.Reader
 	enc  *json.Encoder
+	// max sizes of the messages read, 0 means no limit
+	maxHeader, maxBody int
 }
 
-var _ Codec = (*GobCodec)(nil)
+var _ Codec = (*JsonCodec)(nil)
+var _ Limiter = (*JsonCodec)(nil)
+var _ BodyLimiter = (*JsonCodec)(nil)
 
 func NewJsonCodec(conn io.ReadWriteCloser) Codec {
 	buf := bufio.NewWriter(conn)
 	return &JsonCodec{
 		conn: conn,
 		buf:  buf,
-		dec:  json.NewDecoder(conn),
+		r:    bufio.NewReader(conn),
 		enc:  json.NewEncoder(conn),
 	}
 }
 
+func (c *JsonCodec) SetLimits(maxHeader, maxBody int) {
+	c.maxHeader, c.maxBody = maxHeader, maxBody
+}
+
 func (c *JsonCodec) ReadHeader(h *Header) error {
-	return c.dec.Decode(h)
+	return c.decode(h, c.maxHeader)
 }
 
 func (c *JsonCodec) ReadBody(body interface{}) error {
-	return c.dec.Decode(body)
+	return c.decode(body, c.maxBody)
+}
+
+func (c *JsonCodec) ReadBodyLimit(body interface{}, limit int) error {
+	return c.decode(body, minLimit(limit, c.maxBody))
+}
+
+// decode reads the next message into v, json.Encoder writes one message per line.
+// A nil v discards the message.
+func (c *JsonCodec) decode(v interface{}, limit int) error {
+	line, err := c.readLine(limit)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(line, v)
+}
+
+// readLine returns the next non-blank line. A line longer than limit bytes
+// is discarded and ErrMessageTooLarge returned, 0 means no limit.
+func (c *JsonCodec) readLine(limit int) ([]byte, error) {
+	var line []byte
+	tooLarge := false
+	for {
+		frag, err := c.r.ReadSlice('\n')
+		if !tooLarge {
+			line = append(line, frag...)
+			tooLarge = limit > 0 && len(bytes.TrimRight(line, "\r\n")) > limit
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(bytes.TrimSpace(line)) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if tooLarge {
+			return nil, ErrMessageTooLarge
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			return line, nil
+		}
+		line = line[:0]
+	}
 }
 
 func (c *JsonCodec) Write(h *Header, body interface{}) (err error) {
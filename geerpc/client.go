@@ -52,8 +52,24 @@ type newClientFunc func(conn net.Conn, opt *Option) (client *Client, err error)
 
 var _ io.Closer = (*Client)(nil)
 
+// Caller makes synchronous calls, it is implemented by *Client and *xclient.XClient
+// and used by the typed stubs generated by geerpc-gen.
+type Caller interface {
+	Call(ctx context.Context, serviceMethod string, args, reply interface{}) error
+}
+
+var _ Caller = (*Client)(nil)
+
 var ErrShutdown = errors.New("connection is shut down")
 
+// ServerError represents an error that has been returned from
+// the remote side of the RPC connection.
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
+}
+
 func (client *Client) Close() error {
 	client.mu.Lock()
 	defer client.mu.Unlock()
@@ -71,6 +87,13 @@ func (client *Client) IsAvailable() bool {
 	return !client.shutdown && !client.closing
 }
 
+// NumPending returns the number of calls waiting for a reply.
+func (client *Client) NumPending() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return len(client.pending)
+}
+
 // registerCall：将参数 call 添加到 client.pending 中，并更新 client.seq。
 // removeCall：根据 seq，从 client.pending 中移除对应的 call，并返回。
 // terminateCalls：服务端或客户端发生错误时调用，将 shutdown 设置为 true，且将错误信息通知所有 pending 状态的 call。
@@ -121,16 +144,22 @@ func (client *Client) receive() {
 			// and call was already removed.
 			err = client.cc.ReadBody(nil)
 		case h.Error != "":
-			call.Error = errors.New(h.Error)
+			call.Error = ServerError(h.Error)
 			err = client.cc.ReadBody(nil)
 			call.done()
 		default:
 			err = client.cc.ReadBody(call.Reply)
-			if err != nil {
+			if err == codec.ErrMessageTooLarge {
+				call.Error = fmt.Errorf("rpc client: reply of %s is larger than %d bytes", call.ServiceMethod, client.opt.MaxBodySize)
+			} else if err != nil {
 				call.Error = errors.New("reading body " + err.Error())
 			}
 			call.done()
 		}
+		// a body too large was skipped, the next header can be read
+		if err == codec.ErrMessageTooLarge {
+			err = nil
+		}
 	}
 	client.terminateCalls(err)
 }
@@ -152,6 +181,9 @@ func NewClient(conn net.Conn, opt *Option) (*Client, error) {
 }
 
 func newClientCodec(cc codec.Codec, opt *Option) *Client {
+	if l, ok := cc.(codec.Limiter); ok {
+		l.SetLimits(opt.MaxHeaderSize, opt.MaxBodySize)
+	}
 	client := &Client{
 		seq:     1, // seq starts with 1, 0 means invalid call
 		opt:     opt,
@@ -2,6 +2,7 @@ package geerpc
 
 import (
 	"context"
+	"geerpc/codec"
 	"net"
 	"os"
 	"runtime"
@@ -53,7 +54,8 @@ func TestClient_Call(t *testing.T) {
 	time.Sleep(time.Second)
 	t.Run("client timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr)
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
 		var reply int
 		err := client.Call(ctx, "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
@@ -70,19 +72,46 @@ func TestClient_Call(t *testing.T) {
 
 func TestXDial(t *testing.T) {
 	if runtime.GOOS == "linux" {
-		ch := make(chan struct{})
 		addr := "/tmp/geerpc.sock"
-		go func() {
-			_ = os.Remove(addr)
-			l, err := net.Listen("unix", addr)
-			if err != nil {
-				t.Fatal("failed to listen unix socket")
-			}
-			ch <- struct{}{}
-			Accept(l)
-		}()
-		<-ch
-		_, err := XDial("unix@" + addr)
+		_ = os.Remove(addr)
+		l, err := net.Listen("unix", addr)
+		if err != nil {
+			t.Fatal("failed to listen unix socket")
+		}
+		go Accept(l)
+		_, err = XDial("unix@" + addr)
 		_assert(err == nil, "failed to connect unix socket")
 	}
 }
+
+func TestClient_MessageLimits(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	server.SetMessageLimits(256, 128)
+	var s Slow
+	_ = server.Register(&s)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+
+	for _, codecType := range []codec.Type{codec.GobType, codec.JsonType} {
+		opt := &Option{CodecType: codecType, MaxBodySize: 96}
+		client, err := Dial("tcp", l.Addr().String(), opt)
+		_assert(err == nil, "failed to dial: %v", err)
+		ctx := context.Background()
+		var echo string
+		err = client.Call(ctx, "Slow.Echo", strings.Repeat("a", 60), &echo)
+		_assert(err == nil, "%s: expect a small request to pass, got %v", codecType, err)
+
+		// the limit of Echo is 64 bytes, smaller than the one of the server
+		err = client.Call(ctx, "Slow.Echo", strings.Repeat("a", 200), &echo)
+		_assert(err != nil && strings.Contains(err.Error(), "larger than 64 bytes"), "%s: expect the request to be refused, got %v", codecType, err)
+		var reply []byte
+		err = client.Call(ctx, "Slow.Bytes", 200, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "reply of Slow.Bytes is larger than 96 bytes"), "%s: expect the reply to be refused, got %v", codecType, err)
+		err = client.Call(ctx, "Slow.Bytes", 10, &reply)
+		_assert(err == nil && len(reply) == 10, "%s: expect the connection to be usable, got %v", codecType, err)
+
+		err = client.Call(ctx, "Slow."+strings.Repeat("a", 300), 0, &echo)
+		_assert(err != nil && !client.IsAvailable(), "%s: expect a header too large to close the connection", codecType)
+	}
+}
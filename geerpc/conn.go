@@ -0,0 +1,97 @@
+package geerpc
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Accept retries after temporary errors, waiting longer each time up to maxAcceptDelay.
+const (
+	minAcceptDelay = time.Millisecond * 5
+	maxAcceptDelay = time.Second
+)
+
+// ConnStats are the counters of the connections served by Server.Accept and Server.ServeHTTP.
+type ConnStats struct {
+	Active          int    // connections being served
+	Rejected        uint64 // connections closed because MaxConns was reached
+	RejectedPerIP   uint64 // connections closed because MaxConnsPerIP was reached
+	TemporaryErrors uint64 // temporary accept errors, after which Accept backed off
+	MaxConns        int
+	MaxConnsPerIP   int
+}
+
+// SetConnLimits sets the max number of connections served at once by Accept
+// and ServeHTTP, in total and per remote IP, 0 means no limit. Connections over a limit are
+// closed right away, logged and counted in ConnStats.
+func (server *Server) SetConnLimits(maxConns, maxConnsPerIP int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.connStats.MaxConns, server.connStats.MaxConnsPerIP = maxConns, maxConnsPerIP
+}
+
+// ConnStats returns the counters of the connections accepted so far.
+func (server *Server) ConnStats() ConnStats {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.connStats
+}
+
+// admit counts in a connection from ip, unless it would exceed a limit.
+func (server *Server) admit(ip string) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	stats := &server.connStats
+	if stats.MaxConns > 0 && stats.Active >= stats.MaxConns {
+		stats.Rejected++
+		return fmt.Errorf("too many connections, max %d", stats.MaxConns)
+	}
+	if stats.MaxConnsPerIP > 0 && server.connsPerIP[ip] >= stats.MaxConnsPerIP {
+		stats.RejectedPerIP++
+		return fmt.Errorf("too many connections from %s, max %d", ip, stats.MaxConnsPerIP)
+	}
+	stats.Active++
+	server.connsPerIP[ip]++
+	return nil
+}
+
+// release counts out a connection admitted from ip.
+func (server *Server) release(ip string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.connStats.Active--
+	if server.connsPerIP[ip]--; server.connsPerIP[ip] <= 0 {
+		delete(server.connsPerIP, ip)
+	}
+}
+
+// acceptBackoff returns how long to wait after a temporary accept error,
+// given the previous delay.
+func (server *Server) acceptBackoff(delay time.Duration) time.Duration {
+	server.mu.Lock()
+	server.connStats.TemporaryErrors++
+	server.mu.Unlock()
+	if delay == 0 {
+		return minAcceptDelay
+	}
+	if delay *= 2; delay > maxAcceptDelay {
+		delay = maxAcceptDelay
+	}
+	return delay
+}
+
+// isTemporary reports whether a failed Accept may succeed when retried, e.g. on EMFILE.
+func isTemporary(err error) bool {
+	te, ok := err.(interface{ Temporary() bool })
+	return ok && te.Temporary()
+}
+
+// remoteIP returns the IP of the peer at addr, or the whole address
+// when it's not an IP address, e.g. for a unix socket.
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
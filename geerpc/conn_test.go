@@ -0,0 +1,101 @@
+package geerpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_ConnLimits(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	server.SetConnLimits(2, 1)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	call := func(client *Client) error {
+		var reply int
+		return client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	}
+
+	first, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil && call(first) == nil, "expect the first connection to be served")
+	second, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil && call(second) != nil, "expect the second connection from the same IP to be rejected")
+	stats := server.ConnStats()
+	_assert(stats.Active == 1 && stats.RejectedPerIP == 1, "unexpected stats %+v", stats)
+
+	_ = first.Close()
+	for i := 0; server.ConnStats().Active > 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	third, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil && call(third) == nil, "expect a connection to be served once the first one is closed")
+	_ = third.Close()
+}
+
+func TestServer_ConnLimitsHTTP(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	server.SetConnLimits(0, 1)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	first, err := DialHTTP("tcp", addr)
+	_assert(err == nil, "expect the first connection to be served: %v", err)
+	_, err = DialHTTP("tcp", addr)
+	_assert(err != nil, "expect the second connection from the same IP to be rejected")
+	stats := server.ConnStats()
+	_assert(stats.Active == 1 && stats.RejectedPerIP == 1, "unexpected stats %+v", stats)
+
+	_ = first.Close()
+	for i := 0; server.ConnStats().Active > 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	_assert(server.ConnStats().Active == 0, "expect the closed connection to be released")
+}
+
+// flakyListener fails its first Accept calls with a temporary error.
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary failure" }
+func (temporaryError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServer_AcceptBackoff(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(&flakyListener{Listener: l, failures: 3})
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect Accept to go on after temporary errors, got %v", err)
+	_assert(server.ConnStats().TemporaryErrors == 3, "expect 3 temporary errors counted")
+	_assert(!isTemporary(errors.New("closed")), "expect a plain error not to be temporary")
+}
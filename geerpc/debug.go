@@ -19,10 +19,19 @@ const debugText = `<html>
 	<hr>
 		<table>
 		<th align=center>Method</th><th align=center>Calls</th>
+		<th align=center>Timeout</th><th align=center>Idempotent</th>
+		<th align=center>Max request</th><th align=center>Max concurrency</th><th align=center>Deprecated</th>
 		{{range $name, $mtype := .Method}}
 			<tr>
 			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
 			<td align=center>{{$mtype.NumCalls}}</td>
+			{{with $mtype.Options}}
+			<td align=center>{{if .Timeout}}{{.Timeout}}{{else}}-{{end}}</td>
+			<td align=center>{{.Idempotent}}</td>
+			<td align=center>{{if .MaxRequestSize}}{{.MaxRequestSize}}{{else}}-{{end}}</td>
+			<td align=center>{{if .MaxConcurrency}}{{.MaxConcurrency}}{{else}}-{{end}}</td>
+			<td align=left>{{.Deprecated}}</td>
+			{{end}}
 			</tr>
 		{{end}}
 		</table>
@@ -0,0 +1,127 @@
+package geerpc
+
+import (
+	"sync"
+	"time"
+)
+
+// HealthStatus is the serving status reported by the Health service.
+type HealthStatus string
+
+const (
+	HealthUnknown    HealthStatus = "UNKNOWN"
+	HealthServing    HealthStatus = "SERVING"
+	HealthNotServing HealthStatus = "NOT_SERVING"
+)
+
+// maxWatchWait bounds how long Health.Watch blocks without a change,
+// the client is expected to call Watch again.
+const maxWatchWait = time.Second * 30
+
+// Health is the built-in health check service, every Server registers it,
+// clients call "Health.Check" to know whether the server is able to serve,
+// and "Health.Watch" to wait for the status to change.
+type Health struct {
+	server   *Server
+	mu       sync.Mutex // protect following
+	statuses map[string]HealthStatus
+	changed  chan struct{} // closed and replaced on every change
+}
+
+type HealthCheckArgs struct {
+	Service string // empty means the server as a whole
+}
+
+type HealthCheckReply struct {
+	Status HealthStatus
+}
+
+type HealthWatchArgs struct {
+	Service string       // empty means the server as a whole
+	Status  HealthStatus // the status known by the caller, Watch returns once it differs
+}
+
+func newHealth(server *Server) *Health {
+	return &Health{
+		server:   server,
+		statuses: map[string]HealthStatus{"": HealthServing},
+		changed:  make(chan struct{}),
+	}
+}
+
+// status returns the status of service: the one set by SetServingStatus,
+// or the status of the server for a registered service, or HealthUnknown.
+func (h *Health) status(service string) HealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if status, ok := h.statuses[service]; ok {
+		return status
+	}
+	if _, ok := h.server.serviceMap.Load(service); ok {
+		return h.statuses[""]
+	}
+	return HealthUnknown
+}
+
+func (h *Health) setStatus(service string, status HealthStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.statuses[service] = status
+	h.notify()
+}
+
+// clear forgets the status set for service.
+func (h *Health) clear(service string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.statuses[service]; ok {
+		delete(h.statuses, service)
+		h.notify()
+	}
+}
+
+// setAll sets the status of the server and of every service.
+func (h *Health) setAll(status HealthStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for service := range h.statuses {
+		h.statuses[service] = status
+	}
+	h.notify()
+}
+
+func (h *Health) notify() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+func (h *Health) Check(args HealthCheckArgs, reply *HealthCheckReply) error {
+	reply.Status = h.status(args.Service)
+	return nil
+}
+
+// Watch returns the status of args.Service as soon as it differs from args.Status,
+// or the unchanged status after maxWatchWait.
+func (h *Health) Watch(args HealthWatchArgs, reply *HealthCheckReply) error {
+	timeout := time.NewTimer(maxWatchWait)
+	defer timeout.Stop()
+	for {
+		h.mu.Lock()
+		changed := h.changed
+		h.mu.Unlock()
+		if reply.Status = h.status(args.Service); reply.Status != args.Status {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return nil
+		}
+	}
+}
+
+// SetServingStatus sets the status reported by the Health service for service,
+// an empty service sets the status of the server as a whole.
+func (server *Server) SetServingStatus(service string, status HealthStatus) {
+	server.health.setStatus(service, status)
+}
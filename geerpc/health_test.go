@@ -0,0 +1,70 @@
+package geerpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHealth_Check(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	check := func(service string) HealthStatus {
+		var reply HealthCheckReply
+		_ = server.health.Check(HealthCheckArgs{Service: service}, &reply)
+		return reply.Status
+	}
+	_assert(check("") == HealthServing && check("Foo") == HealthServing, "expect SERVING by default")
+	_assert(check("Bar") == HealthUnknown, "expect UNKNOWN for an unregistered service")
+	server.SetServingStatus("Foo", HealthNotServing)
+	_assert(check("Foo") == HealthNotServing && check("") == HealthServing, "expect a per-service status")
+}
+
+func TestHealth_Watch(t *testing.T) {
+	server := NewServer()
+	done := make(chan HealthStatus)
+	go func() {
+		var reply HealthCheckReply
+		_ = server.health.Watch(HealthWatchArgs{Status: HealthServing}, &reply)
+		done <- reply.Status
+	}()
+	time.Sleep(time.Millisecond * 10)
+	server.SetServingStatus("", HealthNotServing)
+	select {
+	case status := <-done:
+		_assert(status == HealthNotServing, "expect NOT_SERVING, got %s", status)
+	case <-time.After(time.Second):
+		t.Fatal("watch should return on change")
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var b Bar
+	_ = server.Register(&b)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+
+	call := client.Go("Bar.Timeout", 1, new(int), nil)
+	time.Sleep(time.Millisecond * 100)
+	shutdown := make(chan error)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	time.Sleep(time.Millisecond * 100)
+
+	var reply HealthCheckReply
+	err = client.Call(context.Background(), "Health.Check", HealthCheckArgs{}, &reply)
+	_assert(err == nil && reply.Status == HealthNotServing, "expect NOT_SERVING while draining")
+	err = client.Call(context.Background(), "Bar.Timeout", 1, new(int))
+	_assert(err != nil && err.Error() == ErrServerClosed.Error(), "expect new requests to be refused")
+
+	<-call.Done
+	_assert(call.Error == nil, "expect the in-flight request to finish: %v", call.Error)
+	_assert(<-shutdown == nil, "expect a graceful shutdown")
+	_, err = Dial("tcp", l.Addr().String())
+	_assert(err != nil, "expect the listener to be closed")
+}
@@ -0,0 +1,78 @@
+package geerpc
+
+import (
+	"context"
+	"errors"
+)
+
+// AsyncCaller makes asynchronous calls, it is implemented by *Client and *xclient.XClient.
+type AsyncCaller interface {
+	Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call
+}
+
+var _ AsyncCaller = (*Client)(nil)
+
+// Invoke calls serviceMethod through c and returns the typed reply,
+// so callers don't pass untyped reply pointers around:
+//
+//	sum, err := geerpc.Invoke[Args, int](ctx, client, "Foo.Sum", Args{Num1: 1, Num2: 2})
+func Invoke[Req, Resp any](ctx context.Context, c Caller, serviceMethod string, req Req) (Resp, error) {
+	var reply Resp
+	err := c.Call(ctx, serviceMethod, req, &reply)
+	return reply, err
+}
+
+// Future is the typed result of an asynchronous call started by GoInvoke.
+type Future[Resp any] struct {
+	call   *Call
+	reply  Resp
+	done   chan struct{} // closed when the call is complete
+	cancel func(err error)
+}
+
+// GoInvoke calls serviceMethod through c asynchronously and returns
+// a Future of the typed reply.
+func GoInvoke[Req, Resp any](c AsyncCaller, serviceMethod string, req Req) *Future[Resp] {
+	f := &Future[Resp]{done: make(chan struct{})}
+	done := make(chan *Call, 1)
+	call := c.Go(serviceMethod, req, &f.reply, done)
+	if client, ok := c.(*Client); ok {
+		f.cancel = func(err error) {
+			// as in Client.Call, a late reply is dropped,
+			// and the call is completed with err
+			if call := client.removeCall(call.Seq); call != nil {
+				call.Error = err
+				call.done()
+			}
+		}
+	}
+	// the Call is delivered only once, keep it so Wait can be called many times
+	go func() {
+		f.call = <-done
+		close(f.done)
+	}()
+	return f
+}
+
+// Done is closed when the call is complete.
+func (f *Future[Resp]) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait waits for the call to complete and returns its reply,
+// or returns early with an error when ctx is done.
+// For a *Client the pending call is then removed and completes with that error,
+// other callers only stop waiting and the call goes on.
+func (f *Future[Resp]) Wait(ctx context.Context) (Resp, error) {
+	select {
+	case <-ctx.Done():
+		var zero Resp
+		err := errors.New("rpc client: call failed: " + ctx.Err().Error())
+		if f.cancel != nil {
+			f.cancel(err)
+		}
+		return zero, err
+	case <-f.done:
+		return f.reply, f.call.Error
+	}
+}
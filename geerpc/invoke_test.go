@@ -0,0 +1,46 @@
+package geerpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInvoke(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	sum, err := Invoke[Args, int](context.Background(), client, "Foo.Sum", Args{Num1: 1, Num2: 2})
+	_assert(err == nil && sum == 3, "failed to invoke Foo.Sum: %v", err)
+
+	f := GoInvoke[Args, int](client, "Foo.Sum", Args{Num1: 3, Num2: 4})
+	<-f.Done()
+	for i := 0; i < 2; i++ {
+		sum, err = f.Wait(context.Background())
+		_assert(err == nil && sum == 7, "failed to wait Foo.Sum: %v", err)
+	}
+
+	f = GoInvoke[Args, int](client, "Foo.Missing", Args{})
+	_, err = f.Wait(context.Background())
+	_assert(err != nil, "expect an error for a missing method")
+
+	var bar Bar
+	_ = server.Register(&bar)
+	f = GoInvoke[int, int](client, "Bar.Timeout", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = f.Wait(ctx)
+	_assert(err != nil, "expect a timeout error")
+	_assert(client.NumPending() == 0, "expect the call to be removed, got %d pending", client.NumPending())
+	<-f.Done()
+	_, err = f.Wait(context.Background())
+	_assert(err != nil, "expect the call to complete with the timeout error")
+}
@@ -0,0 +1,107 @@
+package geerpc
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// MethodOptions are the settings of a method, enforced by the server
+// and published by the Reflection service and /debug/geerpc.
+type MethodOptions struct {
+	Timeout        time.Duration // handle timeout, overrides Option.HandleTimeout when set
+	Idempotent     bool          // calling twice is harmless, so clients may retry after any failure
+	MaxRequestSize int           // bytes of the encoded args, larger requests are refused, 0 means no limit
+	Deprecated     string        // a notice telling what to use instead, empty means not deprecated
+	MaxConcurrency int           // calls handled at once, others wait their turn, 0 means no limit
+}
+
+// MethodOptioner is implemented by receivers which set the options of their
+// methods at registration, the map is keyed by method name.
+type MethodOptioner interface {
+	MethodOptions() map[string]MethodOptions
+}
+
+// withOptions returns a copy of m with options opts, so that a method being
+// called is never modified. The copy shares the call count of m, which calls
+// still running on m keep adding to.
+func (m *methodType) withOptions(opts MethodOptions) (*methodType, error) {
+	if opts.Timeout < 0 || opts.MaxRequestSize < 0 || opts.MaxConcurrency < 0 {
+		return nil, errors.New("rpc server: negative method option")
+	}
+	nm := &methodType{
+		method:    m.method,
+		fn:        m.fn,
+		ArgType:   m.ArgType,
+		ReplyType: m.ReplyType,
+		Options:   opts,
+		numCalls:  m.numCalls,
+	}
+	if opts.MaxConcurrency > 0 {
+		nm.sem = make(chan struct{}, opts.MaxConcurrency)
+	}
+	return nm, nil
+}
+
+// acquire waits for a free slot when the method has a concurrency limit,
+// it gives up and returns false once abandon is closed.
+func (m *methodType) acquire(abandon <-chan struct{}) bool {
+	if m.sem == nil {
+		return true
+	}
+	select {
+	case m.sem <- struct{}{}:
+		return true
+	case <-abandon:
+		return false
+	}
+}
+
+func (m *methodType) release() {
+	if m.sem != nil {
+		<-m.sem
+	}
+}
+
+// applyOptions sets the options returned by a receiver implementing MethodOptioner.
+func (s *service) applyOptions(options map[string]MethodOptions) error {
+	for name, opts := range options {
+		m := s.method[name]
+		if m == nil {
+			return fmt.Errorf("rpc server: options of unknown method %s.%s", s.name, name)
+		}
+		nm, err := m.withOptions(opts)
+		if err != nil {
+			return err
+		}
+		s.method[name] = nm
+	}
+	return nil
+}
+
+// SetMethodOptions replaces the options of the registered method serviceMethod,
+// calls in flight keep the options they started with.
+func (server *Server) SetMethodOptions(serviceMethod string, opts MethodOptions) error {
+	for {
+		svc, m, err := server.findService(serviceMethod)
+		if err != nil {
+			return err
+		}
+		nm, err := m.withOptions(opts)
+		if err != nil {
+			return err
+		}
+		methodName := serviceMethod[strings.LastIndex(serviceMethod, ".")+1:]
+		if server.serviceMap.CompareAndSwap(svc.name, svc, svc.withMethod(methodName, nm)) {
+			break
+		}
+	}
+	log.Printf("rpc server: set options of %s: %+v\n", serviceMethod, opts)
+	return nil
+}
+
+func SetMethodOptions(serviceMethod string, opts MethodOptions) error {
+	return DefaultServer.SetMethodOptions(serviceMethod, opts)
+}
@@ -0,0 +1,118 @@
+package geerpc
+
+import (
+	"context"
+	"encoding/json"
+	"geerpc/codec"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Slow sets the options of its methods at registration.
+type Slow int
+
+func (s Slow) Sleep(ms int, reply *int) error {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	*reply = ms
+	return nil
+}
+
+func (s Slow) Echo(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+func (s Slow) Bytes(n int, reply *[]byte) error {
+	*reply = make([]byte, n)
+	return nil
+}
+
+func (s Slow) MethodOptions() map[string]MethodOptions {
+	return map[string]MethodOptions{
+		"Sleep": {Timeout: time.Millisecond * 300, Idempotent: true, MaxConcurrency: 1},
+		"Echo":  {MaxRequestSize: 64, Deprecated: "use Sleep"},
+	}
+}
+
+func TestMethodOptions(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var s Slow
+	_assert(server.Register(&s) == nil, "failed to register Slow")
+	svc, m, _ := server.findService("Slow.Sleep")
+	_assert(len(svc.skipped) == 0 && len(svc.method) == 3, "expect MethodOptions not to be a method")
+	_assert(m.Options.Idempotent && m.Options.MaxConcurrency == 1, "expect the options of Sleep")
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	start := time.Now()
+	calls := []*Call{client.Go("Slow.Sleep", 100, new(int), nil), client.Go("Slow.Sleep", 100, new(int), nil)}
+	for _, call := range calls {
+		<-call.Done
+		_assert(call.Error == nil, "expect no error, got %v", call.Error)
+	}
+	_assert(time.Since(start) >= time.Millisecond*200, "expect calls of Sleep to run one at a time")
+
+	for _, codecType := range []codec.Type{codec.GobType, codec.JsonType} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{MagicNumber: MagicNumber, CodecType: codecType})
+		_assert(err == nil, "failed to dial: %v", err)
+		ctx := context.Background()
+
+		var echo string
+		err = client.Call(ctx, "Slow.Echo", strings.Repeat("a", 1024), &echo)
+		_assert(err != nil && strings.Contains(err.Error(), "larger than 64 bytes"), "%s: expect a too large error, got %v", codecType, err)
+		err = client.Call(ctx, "Slow.Echo", "hello", &echo)
+		_assert(err == nil && echo == "hello", "%s: expect the connection to be usable, got %v", codecType, err)
+
+		var reply int
+		err = client.Call(ctx, "Slow.Sleep", 500, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "%s: expect the method timeout, got %v", codecType, err)
+		_ = client.Close()
+	}
+
+	svc, old, _ := server.findService("Slow.Sleep")
+	_assert(server.SetMethodOptions("Slow.Sleep", MethodOptions{}) == nil, "failed to set options")
+	// a call still running on the old method counts for the new one
+	n := old.NumCalls()
+	_ = svc.call(old, reflect.ValueOf(0), reflect.ValueOf(new(int)))
+	_, m, _ = server.findService("Slow.Sleep")
+	_assert(m != old && m.NumCalls() == n+1, "expect the calls to be counted once swapped, got %d", m.NumCalls())
+	var desc MethodDesc
+	err := client.Call(context.Background(), "Reflection.DescribeMethod", DescribeMethodArgs{ServiceMethod: "Slow.Sleep"}, &desc)
+	_assert(err == nil && !desc.Options.Idempotent && desc.Options.Timeout == 0, "expect the new options, got %+v", desc.Options)
+	err = client.Call(context.Background(), "Reflection.DescribeMethod", DescribeMethodArgs{ServiceMethod: "Slow.Echo"}, &desc)
+	_assert(err == nil && desc.Options.Deprecated == "use Sleep", "expect the deprecation notice, got %+v", desc.Options)
+	_assert(server.SetMethodOptions("Slow.Nope", MethodOptions{}) != nil, "expect an error for a missing method")
+}
+
+func TestServer_HandleTimeout(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var s Slow
+	_ = server.Register(&s)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	_ = json.NewEncoder(conn).Encode(&Option{MagicNumber: MagicNumber, CodecType: codec.JsonType})
+	cc := codec.NewJsonCodec(conn)
+	_ = cc.Write(&codec.Header{ServiceMethod: "Slow.Sleep", Seq: 1}, 500)
+	var h codec.Header
+	_assert(cc.ReadHeader(&h) == nil && strings.Contains(h.Error, "handle timeout"), "expect the method timeout, got %+v", h)
+	_ = cc.ReadBody(nil)
+	_assert(atomic.LoadInt64(&server.inflight) == 1, "expect the call to count until the method returns")
+
+	// the late reply of the method isn't sent
+	_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	_assert(cc.ReadHeader(&h) != nil, "expect no second response, got %+v", h)
+	_assert(atomic.LoadInt64(&server.inflight) == 0, "expect the call to be done")
+}
@@ -0,0 +1,181 @@
+package geerpc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Reflection is the built-in service describing what a server offers,
+// every Server registers it. Clients and tools call "Reflection.ListServices"
+// and "Reflection.DescribeMethod" instead of reading /debug/geerpc.
+type Reflection struct {
+	server *Server
+}
+
+// TypeDesc describes a Go type, derived via reflect.
+type TypeDesc struct {
+	Name   string      // e.g. "int", "geerpc.Args", "*geerpc.Args"
+	Kind   string      // reflect.Kind, e.g. "struct", "ptr", "slice"
+	Elem   *TypeDesc   // element of ptr, slice, array and map
+	Key    *TypeDesc   // key of map
+	Fields []FieldDesc // exported fields of struct
+}
+
+type FieldDesc struct {
+	Name string
+	Type *TypeDesc
+}
+
+type MethodDesc struct {
+	Name      string
+	ArgType   *TypeDesc
+	ReplyType *TypeDesc
+	Options   MethodOptions
+}
+
+type ServiceDesc struct {
+	Name    string
+	Methods []MethodDesc    // sorted by name
+	Skipped []SkippedMethod // exported methods which can't be called, and why
+}
+
+type ListServicesArgs struct {
+	Service string // only describe this service, empty means all
+}
+
+type ListServicesReply struct {
+	Services []ServiceDesc // sorted by name
+}
+
+type DescribeMethodArgs struct {
+	ServiceMethod string // format "<service>.<method>"
+}
+
+// DescribeType describes t, types met again inside themselves are not expanded.
+func DescribeType(t reflect.Type) *TypeDesc {
+	return describeType(t, make(map[reflect.Type]bool))
+}
+
+func describeType(t reflect.Type, visiting map[reflect.Type]bool) *TypeDesc {
+	d := &TypeDesc{Name: t.String(), Kind: t.Kind().String()}
+	if visiting[t] {
+		return d
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		d.Elem = describeType(t.Elem(), visiting)
+	case reflect.Map:
+		d.Key = describeType(t.Key(), visiting)
+		d.Elem = describeType(t.Elem(), visiting)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			d.Fields = append(d.Fields, FieldDesc{Name: f.Name, Type: describeType(f.Type, visiting)})
+		}
+	}
+	return d
+}
+
+// Match reports whether values of t can be exchanged with a peer using the
+// type described by d: same kinds, and fields of structs found by name.
+// Pointers are followed on both sides, as the codecs do.
+func (d *TypeDesc) Match(t reflect.Type) error {
+	return d.match(t, "")
+}
+
+func (d *TypeDesc) match(t reflect.Type, path string) error {
+	for d.Kind == reflect.Ptr.String() && d.Elem != nil {
+		d = d.Elem
+	}
+	if d.Kind == reflect.Ptr.String() {
+		return nil // a recursive type which isn't expanded
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if path == "" {
+		path = t.String()
+	}
+	if d.Kind != t.Kind().String() {
+		return fmt.Errorf("rpc reflection: %s is %s, expect %s", path, t.Kind(), d.Kind)
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if d.Elem != nil {
+			return d.Elem.match(t.Elem(), path+"[]")
+		}
+	case reflect.Map:
+		if d.Key != nil {
+			if err := d.Key.match(t.Key(), path+"[key]"); err != nil {
+				return err
+			}
+		}
+		if d.Elem != nil {
+			return d.Elem.match(t.Elem(), path+"[]")
+		}
+	case reflect.Struct:
+		for _, f := range d.Fields {
+			sf, ok := t.FieldByName(f.Name)
+			if !ok {
+				return fmt.Errorf("rpc reflection: %s has no field %s", path, f.Name)
+			}
+			if err := f.Type.match(sf.Type, path+"."+f.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func describeService(svc *service) ServiceDesc {
+	d := ServiceDesc{Name: svc.name, Skipped: svc.skipped}
+	for name, m := range svc.method {
+		d.Methods = append(d.Methods, MethodDesc{
+			Name:      name,
+			ArgType:   DescribeType(m.ArgType),
+			ReplyType: DescribeType(m.ReplyType),
+			Options:   m.Options,
+		})
+	}
+	sort.Slice(d.Methods, func(i, j int) bool { return d.Methods[i].Name < d.Methods[j].Name })
+	return d
+}
+
+func (r *Reflection) ListServices(args ListServicesArgs, reply *ListServicesReply) error {
+	if args.Service != "" {
+		svci, ok := r.server.serviceMap.Load(args.Service)
+		if !ok {
+			return errors.New("rpc server: can't find service " + args.Service)
+		}
+		reply.Services = []ServiceDesc{describeService(svci.(*service))}
+		return nil
+	}
+	r.server.serviceMap.Range(func(_, svci interface{}) bool {
+		reply.Services = append(reply.Services, describeService(svci.(*service)))
+		return true
+	})
+	sort.Slice(reply.Services, func(i, j int) bool { return reply.Services[i].Name < reply.Services[j].Name })
+	return nil
+}
+
+func (r *Reflection) DescribeMethod(args DescribeMethodArgs, reply *MethodDesc) error {
+	_, mType, err := r.server.findService(args.ServiceMethod)
+	if err != nil {
+		return err
+	}
+	*reply = MethodDesc{
+		Name:      args.ServiceMethod[strings.LastIndex(args.ServiceMethod, ".")+1:],
+		ArgType:   DescribeType(mType.ArgType),
+		ReplyType: DescribeType(mType.ReplyType),
+		Options:   mType.Options,
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package geerpc
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type Node struct {
+	Value int
+	Next  *Node
+}
+
+func TestDescribeType(t *testing.T) {
+	d := DescribeType(reflect.TypeOf(&Node{}))
+	_assert(d.Kind == "ptr" && d.Elem.Kind == "struct" && len(d.Elem.Fields) == 2, "unexpected %+v", d)
+	next := d.Elem.Fields[1].Type
+	_assert(next.Name == "*geerpc.Node" && next.Elem == nil, "a recursive type shouldn't be expanded again")
+
+	_assert(d.Match(reflect.TypeOf(Node{})) == nil, "expect the same type to match")
+	err := DescribeType(reflect.TypeOf(Args{})).Match(reflect.TypeOf(Node{}))
+	_assert(err != nil && strings.Contains(err.Error(), "no field Num1"), "expect a missing field, got %v", err)
+}
+
+func TestReflection(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var list ListServicesReply
+	err = client.Call(context.Background(), "Reflection.ListServices", ListServicesArgs{}, &list)
+	_assert(err == nil && len(list.Services) == 3, "expect Foo, Health and Reflection, got %+v, %v", list, err)
+
+	var m MethodDesc
+	err = client.Call(context.Background(), "Reflection.DescribeMethod", DescribeMethodArgs{ServiceMethod: "Foo.Sum"}, &m)
+	_assert(err == nil && m.Name == "Sum", "failed to describe Foo.Sum: %v", err)
+	_assert(m.ArgType.Match(reflect.TypeOf(Args{})) == nil, "expect the arg type to match")
+	_assert(m.ReplyType.Kind == "ptr" && m.ReplyType.Elem.Kind == "int", "unexpected reply type %+v", m.ReplyType)
+}
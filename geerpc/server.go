@@ -1,6 +1,8 @@
 package geerpc
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,8 +12,10 @@ import (
 	"net"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,11 +32,24 @@ type Option struct {
 	CodecType      codec.Type    // client may choose different Codec to encode body
 	ConnectTimeout time.Duration // 默认值为 10s
 	HandleTimeout  time.Duration // 0 means no limit
+	MaxHeaderSize  int           // bytes of a response header the client reads, 0 means no limit
+	MaxBodySize    int           // bytes of a response body the client reads, 0 means no limit
 }
 
 // Server represents an RPC Server.
 type Server struct {
 	serviceMap sync.Map
+	health     *Health
+	inShutdown int32         // accessed atomically, non-zero once Shutdown is called
+	done       chan struct{} // closed when Shutdown is called
+	inflight   int64         // accessed atomically, requests being handled
+	mu         sync.Mutex    // protect following
+	listeners  map[net.Listener]struct{}
+	conns      map[io.Closer]struct{}
+	maxHeader  int // bytes of a request header, 0 means no limit
+	maxBody    int // bytes of a request body, 0 means no limit
+	connStats  ConnStats
+	connsPerIP map[string]int // connections being served by Accept per remote IP
 }
 
 type request struct {
@@ -54,21 +71,170 @@ var DefaultServer = NewServer()
 // invalidRequest is a placeholder for response argv when error occurs
 var invalidRequest = struct{}{}
 
+// ErrServerClosed is returned to requests arriving after Shutdown.
+var ErrServerClosed = errors.New("rpc server: server closed")
+
+// shutdownPollInterval is how often Shutdown checks for in-flight requests.
+const shutdownPollInterval = time.Millisecond * 10
+
+// Default limits of the requests read by a Server, see SetMessageLimits.
+const (
+	DefaultMaxHeaderSize = 64 << 10
+	DefaultMaxBodySize   = 32 << 20
+)
+
+// maxOptionSize bounds the JSON encoded Option starting a connection.
+const maxOptionSize = 4 << 10
+
 func NewServer() *Server {
-	return &Server{}
+	server := &Server{
+		listeners:  make(map[net.Listener]struct{}),
+		conns:      make(map[io.Closer]struct{}),
+		maxHeader:  DefaultMaxHeaderSize,
+		maxBody:    DefaultMaxBodySize,
+		connsPerIP: make(map[string]int),
+		done:       make(chan struct{}),
+	}
+	server.health = newHealth(server)
+	// the built-in services are registered silently
+	for _, rcvr := range []interface{}{server.health, &Reflection{server: server}} {
+		s, _ := newService(rcvr, "")
+		server.serviceMap.Store(s.name, s)
+	}
+	return server
+}
+
+// SetMessageLimits sets the max sizes in bytes of the request headers and
+// bodies, 0 means no limit. They're enforced by the codec before decoding:
+// a request whose body is too large fails with an error, a header too large
+// closes the connection. It applies to connections accepted afterwards.
+func (server *Server) SetMessageLimits(maxHeader, maxBody int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.maxHeader, server.maxBody = maxHeader, maxBody
+}
+
+func (server *Server) messageLimits() (maxHeader, maxBody int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.maxHeader, server.maxBody
 }
 
 // Accept accepts connections on the listener and serves requests
-// for each incoming connection.
+// for each incoming connection. Connections over the limits set by
+// SetConnLimits are closed, temporary errors are retried with backoff.
 func (server *Server) Accept(lis net.Listener) {
+	if !server.trackListener(lis, true) {
+		_ = lis.Close()
+		return
+	}
+	defer server.trackListener(lis, false)
+	var delay time.Duration // backoff after temporary errors
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
+			if server.shuttingDown() {
+				return
+			}
+			if isTemporary(err) {
+				delay = server.acceptBackoff(delay)
+				log.Printf("rpc server: accept error: %v; retrying in %v\n", err, delay)
+				time.Sleep(delay)
+				continue
+			}
 			log.Println("rpc server: accept error:", err)
 			return
 		}
-		go server.ServeConn(conn)
+		delay = 0
+		ip := remoteIP(conn.RemoteAddr().String())
+		if err := server.admit(ip); err != nil {
+			log.Printf("rpc server: reject connection from %s: %v\n", conn.RemoteAddr(), err)
+			_ = conn.Close()
+			continue
+		}
+		go func() {
+			defer server.release(ip)
+			server.ServeConn(conn)
+		}()
+	}
+}
+
+func (server *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&server.inShutdown) != 0
+}
+
+// trackListener adds or removes lis, it refuses to add once the server is shutting down.
+func (server *Server) trackListener(lis net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if add {
+		if server.shuttingDown() {
+			return false
+		}
+		server.listeners[lis] = struct{}{}
+	} else {
+		delete(server.listeners, lis)
+	}
+	return true
+}
+
+func (server *Server) trackConn(conn io.Closer, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if add {
+		if server.shuttingDown() {
+			return false
+		}
+		server.conns[conn] = struct{}{}
+	} else {
+		delete(server.conns, conn)
 	}
+	return true
+}
+
+// Done returns a channel closed when Shutdown is called, so that long
+// running methods such as watches can return early instead of delaying it.
+func (server *Server) Done() <-chan struct{} {
+	return server.done
+}
+
+// Shutdown gracefully shuts down the server: the Health service reports
+// NOT_SERVING first, then listeners are closed, new requests are refused
+// with ErrServerClosed, and the connections are closed once all in-flight
+// requests are handled. If ctx expires first, the connections are closed anyway
+// and the context's error is returned.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.health.setAll(HealthNotServing)
+
+	server.mu.Lock()
+	if !server.shuttingDown() {
+		close(server.done)
+	}
+	atomic.StoreInt32(&server.inShutdown, 1)
+	for lis := range server.listeners {
+		_ = lis.Close()
+		delete(server.listeners, lis)
+	}
+	server.mu.Unlock()
+
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+	var err error
+	for atomic.LoadInt64(&server.inflight) > 0 && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-t.C:
+		}
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for conn := range server.conns {
+		_ = conn.Close()
+		delete(server.conns, conn)
+	}
+	return err
 }
 
 // Accept accepts connections on the listener and serves requests
@@ -78,10 +244,15 @@ func Accept(lis net.Listener) { DefaultServer.Accept(lis) }
 // 服务连接
 func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 	defer func() { _ = conn.Close() }()
+	if !server.trackConn(conn, true) {
+		return
+	}
+	defer server.trackConn(conn, false)
 	var opt Option
 	// 使用 json.NewDecoder 反序列化得到 Option 实例，
 	// 检查 MagicNumber 和 CodeType 的值是否正确
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	dec := json.NewDecoder(io.LimitReader(conn, maxOptionSize))
+	if err := dec.Decode(&opt); err != nil {
 		log.Println("rpc server: options error: ", err)
 		return
 	}
@@ -95,9 +266,31 @@ func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 		log.Printf("rpc server: invalid codec type %s", opt.CodecType)
 		return
 	}
-	server.serveCodec(f(conn), &opt)
+	// the json decoder may have buffered the beginning of the first request,
+	// hand those bytes back to the codec before reading from conn again
+	r := bufio.NewReader(io.MultiReader(dec.Buffered(), conn))
+	// json.Encoder terminates the option with a newline
+	if b, err := r.Peek(1); err == nil && b[0] == '\n' {
+		_, _ = r.Discard(1)
+	}
+	cc := f(&bufferedConn{Reader: r, conn: conn})
+	if l, ok := cc.(codec.Limiter); ok {
+		l.SetLimits(server.messageLimits())
+	}
+	server.serveCodec(cc, &opt)
 }
 
+// bufferedConn replays the bytes read ahead by the option decoder
+// before continuing with the underlying connection.
+type bufferedConn struct {
+	io.Reader
+	conn io.ReadWriteCloser
+}
+
+func (c *bufferedConn) Write(p []byte) (int, error) { return c.conn.Write(p) }
+
+func (c *bufferedConn) Close() error { return c.conn.Close() }
+
 // 服务编解码
 func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
 	// 读取请求 readRequest
@@ -107,6 +300,10 @@ func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
 	wg := new(sync.WaitGroup)  // wait until all request are handled
 	for {
 		req, err := server.readRequest(cc)
+		if err == nil && server.shuttingDown() && !server.isHealthRequest(req) {
+			// let health checks see NOT_SERVING while draining
+			err = ErrServerClosed
+		}
 		if err != nil {
 			if req == nil {
 				break // it's not possible to recover, so close the connection
@@ -116,12 +313,25 @@ func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
 			continue
 		}
 		wg.Add(1)
-		go server.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
+		if !server.isHealthRequest(req) {
+			atomic.AddInt64(&server.inflight, 1)
+		}
+		timeout := opt.HandleTimeout
+		if req.mType.Options.Timeout > 0 {
+			timeout = req.mType.Options.Timeout
+		}
+		go server.handleRequest(cc, req, sending, wg, timeout)
 	}
 	wg.Wait()
 	_ = cc.Close()
 }
 
+// isHealthRequest reports whether req calls the Health service,
+// such requests are served while shutting down and aren't waited for.
+func (server *Server) isHealthRequest(req *request) bool {
+	return req.svc != nil && req.svc.rcvr.IsValid() && req.svc.rcvr.Interface() == server.health
+}
+
 func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 	var h codec.Header
 	if err := cc.ReadHeader(&h); err != nil {
@@ -142,6 +352,11 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	req := &request{h: h}
 	req.svc, req.mType, err = server.findService(h.ServiceMethod)
 	if err != nil {
+		// skip the body, or the next request is read from the middle of it,
+		// a body too large for the limits is skipped as well
+		if bodyErr := cc.ReadBody(nil); bodyErr != nil && bodyErr != codec.ErrMessageTooLarge {
+			return nil, bodyErr
+		}
 		return req, err
 	}
 
@@ -153,7 +368,21 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	if req.argv.Type().Kind() != reflect.Ptr {
 		argvi = req.argv.Addr().Interface()
 	}
-	if err = cc.ReadBody(argvi); err != nil {
+	// a codec which can't refuse a body before decoding it isn't limited
+	if bl, ok := cc.(codec.BodyLimiter); ok && req.mType.Options.MaxRequestSize > 0 {
+		err = bl.ReadBodyLimit(argvi, req.mType.Options.MaxRequestSize)
+	} else {
+		err = cc.ReadBody(argvi)
+	}
+	if err == codec.ErrMessageTooLarge {
+		// the body was skipped, so the connection goes on
+		_, limit := server.messageLimits()
+		if m := req.mType.Options.MaxRequestSize; m > 0 && (limit == 0 || m < limit) {
+			limit = m
+		}
+		return req, fmt.Errorf("rpc server: request of %s is larger than %d bytes", h.ServiceMethod, limit)
+	}
+	if err != nil {
 		log.Println("rpc server: read body err:", err)
 		return req, err
 	}
@@ -173,50 +402,189 @@ func (server *Server) sendResponse(cc codec.Codec, h *codec.Header,
 func (server *Server) handleRequest(cc codec.Codec, req *request,
 	sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
 	// 服务端处理报文超时
-	defer wg.Done()
+	if req.mType.Options.Deprecated != "" {
+		req.mType.warnOnce.Do(func() {
+			log.Printf("rpc server: %s is deprecated: %s\n", req.h.ServiceMethod, req.mType.Options.Deprecated)
+		})
+	}
+	var answered int32 // set by the first of the call and the timeout to respond
 	called := make(chan struct{})
-	sent := make(chan struct{})
+	abandoned := make(chan struct{}) // closed on timeout
 	go func() {
+		// the request is done once the method returned, even after a timeout,
+		// so that Shutdown and the connection wait for it
+		defer wg.Done()
+		if !server.isHealthRequest(req) {
+			defer atomic.AddInt64(&server.inflight, -1)
+		}
+		defer close(called)
+		// a call waiting for its turn gives up on timeout
+		if !req.mType.acquire(abandoned) {
+			return
+		}
 		// 调用方法超时
 		err := req.svc.call(req.mType, req.argv, req.replyv)
-		called <- struct{}{}
+		req.mType.release()
+		if !atomic.CompareAndSwapInt32(&answered, 0, 1) {
+			return // the timeout was sent instead
+		}
+		h := *req.h
 		if err != nil {
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sending)
-			sent <- struct{}{}
+			h.Error = err.Error()
+			server.sendResponse(cc, &h, invalidRequest, sending)
 			return
 		}
 
 		// 发送报文超时
-		server.sendResponse(cc, req.h, req.replyv.Interface(), sending)
-		sent <- struct{}{}
+		server.sendResponse(cc, &h, req.replyv.Interface(), sending)
 	}()
 
 	if timeout == 0 {
 		<-called
-		<-sent
 		return
 	}
 	select {
 	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, sending)
+		close(abandoned)
+		if atomic.CompareAndSwapInt32(&answered, 0, 1) {
+			h := *req.h
+			h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
+			server.sendResponse(cc, &h, invalidRequest, sending)
+		}
 	case <-called:
-		<-sent
 	}
 }
 
 // 将rcvr提供的方法都注册到服务器维护的serviceMap中
+// Register publishes the methods of rcvr as a service named after its type.
+// Exported methods of unsuitable signature are skipped and logged.
 func (server *Server) Register(rcvr interface{}) error {
-	s := newService(rcvr)
+	return server.RegisterName("", rcvr)
+}
+
+// builtinServices are registered on every Server, their names are reserved.
+var builtinServices = map[string]bool{"Health": true, "Reflection": true}
+
+// checkReserved refuses to change the built-in service name.
+func checkReserved(name string) error {
+	if builtinServices[name] {
+		return fmt.Errorf("rpc server: %s is a built-in service, use RegisterName to pick another name", name)
+	}
+	return nil
+}
+
+// RegisterName is like Register, but uses name as the service name.
+func (server *Server) RegisterName(name string, rcvr interface{}) error {
+	s, err := newService(rcvr, name)
+	if err != nil {
+		return err
+	}
+	if err := checkReserved(s.name); err != nil {
+		return err
+	}
 	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
 		return errors.New("rpc: service already defined: " + s.name)
 	}
+	names := make([]string, 0, len(s.method))
+	for name := range s.method {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("rpc server: register %s.%s\n", s.name, name)
+	}
+	for _, m := range s.skipped {
+		log.Printf("rpc server: skip %s.%s: %s\n", s.name, m.Name, m.Reason)
+	}
+	return nil
+}
+
+// RegisterFunc publishes the plain function fn, of the form
+// func(argType T1, replyType *T2) error, as the method serviceMethod.
+// The service is created when it doesn't exist yet.
+func (server *Server) RegisterFunc(serviceMethod string, fn interface{}) error {
+	dot := strings.LastIndex(serviceMethod, ".")
+	if dot <= 0 || dot == len(serviceMethod)-1 {
+		return errors.New("rpc server: service/method ill-formed: " + serviceMethod)
+	}
+	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
+	if err := checkReserved(serviceName); err != nil {
+		return err
+	}
+	m, err := newFuncMethod(fn)
+	if err != nil {
+		return err
+	}
+	for {
+		svci, ok := server.serviceMap.Load(serviceName)
+		if !ok {
+			s := &service{name: serviceName, method: map[string]*methodType{methodName: m}}
+			if _, dup := server.serviceMap.LoadOrStore(serviceName, s); !dup {
+				break
+			}
+			continue
+		}
+		svc := svci.(*service)
+		if svc.method[methodName] != nil {
+			return errors.New("rpc: method already defined: " + serviceMethod)
+		}
+		// replace the service by a copy, calls in flight keep using the old one
+		if server.serviceMap.CompareAndSwap(serviceName, svc, svc.withMethod(methodName, m)) {
+			break
+		}
+	}
+	log.Printf("rpc server: register %s\n", serviceMethod)
+	return nil
+}
+
+// Unregister removes the service name, calls in flight finish normally,
+// later calls fail with "can't find service".
+func (server *Server) Unregister(name string) error {
+	if err := checkReserved(name); err != nil {
+		return err
+	}
+	if _, ok := server.serviceMap.LoadAndDelete(name); !ok {
+		return errors.New("rpc server: can't find service " + name)
+	}
+	server.health.clear(name)
+	log.Println("rpc server: unregister", name)
+	return nil
+}
+
+// Replace atomically replaces the service named after the type of rcvr,
+// or registers it when there's none. Calls in flight finish on the old
+// implementation, later calls go to the new one.
+func (server *Server) Replace(rcvr interface{}) error {
+	return server.ReplaceName("", rcvr)
+}
+
+// ReplaceName is like Replace, but uses name as the service name.
+// Methods added to the old service by RegisterFunc are dropped.
+func (server *Server) ReplaceName(name string, rcvr interface{}) error {
+	s, err := newService(rcvr, name)
+	if err != nil {
+		return err
+	}
+	if err := checkReserved(s.name); err != nil {
+		return err
+	}
+	server.serviceMap.Store(s.name, s)
+	log.Printf("rpc server: replace %s by %s\n", s.name, s.typ)
 	return nil
 }
 
 func Register(rcvr interface{}) error { return DefaultServer.Register(rcvr) }
 
+func RegisterName(name string, rcvr interface{}) error { return DefaultServer.RegisterName(name, rcvr) }
+
+func RegisterFunc(serviceMethod string, fn interface{}) error {
+	return DefaultServer.RegisterFunc(serviceMethod, fn)
+}
+
+func Unregister(name string) error { return DefaultServer.Unregister(name) }
+
+func Replace(rcvr interface{}) error { return DefaultServer.Replace(rcvr) }
+
 func (server *Server) findService(serviceMethod string) (
 	svc *service, mType *methodType, err error) {
 
@@ -250,6 +618,15 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	ip := remoteIP(req.RemoteAddr)
+	if err := server.admit(ip); err != nil {
+		log.Printf("rpc server: reject connection from %s: %v\n", req.RemoteAddr, err)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, "503 "+err.Error()+"\n")
+		return
+	}
+	defer server.release(ip)
 	conn, _, err := w.(http.Hijacker).Hijack()
 	if err != nil {
 		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
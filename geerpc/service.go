@@ -1,28 +1,46 @@
 package geerpc
 
 import (
+	"errors"
+	"fmt"
 	"go/ast"
-	"log"
 	"reflect"
+	"sync"
 	"sync/atomic"
 )
 
 type methodType struct {
 	method    reflect.Method
+	fn        reflect.Value // set for a plain function registered by RegisterFunc
 	ArgType   reflect.Type
 	ReplyType reflect.Type
-	numCalls  uint64
+	Options   MethodOptions
+	sem       chan struct{} // holds a token per call being handled when MaxConcurrency is set
+	numCalls  *uint64       // shared with the copies made by withOptions
+	warnOnce  sync.Once     // logs the deprecation notice once
 }
 
 type service struct {
-	name   string
-	typ    reflect.Type
-	rcvr   reflect.Value
-	method map[string]*methodType
+	name    string
+	typ     reflect.Type
+	rcvr    reflect.Value
+	method  map[string]*methodType
+	skipped []SkippedMethod
 }
 
+// SkippedMethod is an exported method which can't be called remotely.
+type SkippedMethod struct {
+	Name   string
+	Reason string
+}
+
+var (
+	typeOfError          = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfMethodOptioner = reflect.TypeOf((*MethodOptioner)(nil)).Elem()
+)
+
 func (m *methodType) NumCalls() uint64 {
-	return atomic.LoadUint64(&m.numCalls)
+	return atomic.LoadUint64(m.numCalls)
 }
 
 func (m *methodType) newArgv() reflect.Value {
@@ -49,50 +67,128 @@ func (m *methodType) newReplyv() reflect.Value {
 	return replyv
 }
 
-func newService(rcvr interface{}) *service {
+// newService creates a service of the exported methods of rcvr,
+// named name, or after the type of rcvr when name is empty.
+func newService(rcvr interface{}, name string) (*service, error) {
+	if rcvr == nil {
+		return nil, errors.New("rpc server: nil receiver")
+	}
 	var s *service = new(service)
 	s.rcvr = reflect.ValueOf(rcvr)
 	s.typ = reflect.TypeOf(rcvr)
-	s.name = reflect.Indirect(s.rcvr).Type().Name()
-	if !ast.IsExported(s.name) {
-		log.Fatalf("rpc server: %s is not a valid service name", s.name)
+	s.name = name
+	if s.name == "" {
+		s.name = reflect.Indirect(s.rcvr).Type().Name()
+		if !ast.IsExported(s.name) {
+			return nil, fmt.Errorf("rpc server: %s is not a valid service name", s.name)
+		}
 	}
 	s.registerMethods()
-	return s
+	if len(s.method) == 0 {
+		return nil, fmt.Errorf("rpc server: type %s has no methods of suitable type%s", s.typ, s.skippedString())
+	}
+	if o, ok := rcvr.(MethodOptioner); ok {
+		if err := s.applyOptions(o.MethodOptions()); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 func (s *service) registerMethods() {
 	s.method = make(map[string]*methodType)
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
-		mType := method.Type
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
-			continue
-		}
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		if method.Name == "MethodOptions" && s.typ.Implements(typeOfMethodOptioner) {
 			continue
 		}
-		argType, replyType := mType.In(1), mType.In(2)
-		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
+		// the receiver is the first argument
+		argType, replyType, err := checkSignature(method.Type, 1)
+		if err != nil {
+			s.skipped = append(s.skipped, SkippedMethod{Name: method.Name, Reason: err.Error()})
 			continue
 		}
 		s.method[method.Name] = &methodType{
 			method:    method,
 			ArgType:   argType,
 			ReplyType: replyType,
+			numCalls:  new(uint64),
 		}
-		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
 }
 
+// checkSignature checks that the arguments of fnType after the first skip ones
+// are (argType T1, replyType *T2), and that it returns an error.
+func checkSignature(fnType reflect.Type, skip int) (argType, replyType reflect.Type, err error) {
+	if fnType.NumIn() != skip+2 || fnType.NumOut() != 1 {
+		return nil, nil, errors.New("needs exactly two arguments and one result")
+	}
+	if fnType.Out(0) != typeOfError {
+		return nil, nil, fmt.Errorf("returns %s, not error", fnType.Out(0))
+	}
+	argType, replyType = fnType.In(skip), fnType.In(skip+1)
+	if !isExportedOrBuiltinType(argType) {
+		return nil, nil, fmt.Errorf("argument type %s is not exported", argType)
+	}
+	if replyType.Kind() != reflect.Ptr {
+		return nil, nil, fmt.Errorf("reply type %s is not a pointer", replyType)
+	}
+	if !isExportedOrBuiltinType(replyType) {
+		return nil, nil, fmt.Errorf("reply type %s is not exported", replyType)
+	}
+	return argType, replyType, nil
+}
+
+// newFuncMethod creates the methodType of a plain function func(argType T1, replyType *T2) error.
+func newFuncMethod(fn interface{}) (*methodType, error) {
+	f := reflect.ValueOf(fn)
+	if f.Kind() != reflect.Func {
+		return nil, fmt.Errorf("rpc server: %T is not a function", fn)
+	}
+	argType, replyType, err := checkSignature(f.Type(), 0)
+	if err != nil {
+		return nil, fmt.Errorf("rpc server: function %s %s", f.Type(), err)
+	}
+	return &methodType{fn: f, ArgType: argType, ReplyType: replyType, numCalls: new(uint64)}, nil
+}
+
+// withMethod returns a copy of s with the method name set to m,
+// so that a service being called is never modified.
+func (s *service) withMethod(name string, m *methodType) *service {
+	ns := *s
+	ns.method = make(map[string]*methodType, len(s.method)+1)
+	for n, mt := range s.method {
+		ns.method[n] = mt
+	}
+	ns.method[name] = m
+	return &ns
+}
+
+func (s *service) skippedString() string {
+	var str string
+	for _, m := range s.skipped {
+		str += fmt.Sprintf(", %s: %s", m.Name, m.Reason)
+	}
+	return str
+}
+
+// isExportedOrBuiltinType checks the type pointed to, like net/rpc,
+// as a pointer type has no name nor package.
 func isExportedOrBuiltinType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
 func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
-	atomic.AddUint64(&m.numCalls, 1)
-	f := m.method.Func
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	atomic.AddUint64(m.numCalls, 1)
+	var returnValues []reflect.Value
+	if m.fn.IsValid() {
+		returnValues = m.fn.Call([]reflect.Value{argv, replyv})
+	} else {
+		returnValues = m.method.Func.Call([]reflect.Value{s.rcvr, argv, replyv})
+	}
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
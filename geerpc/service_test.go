@@ -1,9 +1,13 @@
 package geerpc
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 type Foo int
@@ -28,7 +32,7 @@ func _assert(condition bool, msg string, v ...interface{}) {
 }
 func TestNewService(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
+	s, _ := newService(&foo, "")
 	_assert(len(s.method) == 1, "wrong service Method, expect 1, but got %d", len(s.method))
 	mType := s.method["Sum"]
 	_assert(mType != nil, "wrong Method, Sum shouldn't nil")
@@ -36,7 +40,7 @@ func TestNewService(t *testing.T) {
 
 func TestMethodType_Call(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
+	s, _ := newService(&foo, "")
 	mType := s.method["Sum"]
 
 	argv := mType.newArgv()
@@ -45,3 +49,118 @@ func TestMethodType_Call(t *testing.T) {
 	err := s.call(mType, argv, replyv)
 	_assert(err == nil && *replyv.Interface().(*int) == 4 && mType.NumCalls() == 1, "failed to call Foo.Sum")
 }
+
+type Baz int
+
+func (b Baz) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+// it can't be called remotely, reply isn't a pointer
+func (b Baz) Div(args Args, reply int) error {
+	return nil
+}
+
+type unexported int
+
+func (u unexported) Sum(args Args, reply *int) error { return nil }
+
+// Pub has methods with unexported types behind pointers.
+type Pub int
+
+func (p Pub) Ok(args *Args, reply *int) error            { return nil }
+func (p Pub) BadReply(args int, reply *unexported) error { return nil }
+func (p Pub) BadArgs(args *unexported, reply *int) error { return nil }
+
+func TestServer_Register(t *testing.T) {
+	server := NewServer()
+	var baz Baz
+	s, err := newService(&baz, "")
+	_assert(err == nil && len(s.method) == 1 && len(s.skipped) == 1 && s.skipped[0].Name == "Div",
+		"expect Div to be skipped, got %+v", s.skipped)
+	var pub Pub
+	s, err = newService(&pub, "")
+	_assert(err == nil && len(s.method) == 1 && s.method["Ok"] != nil && len(s.skipped) == 2,
+		"expect the methods of unexported pointer types to be skipped, got %+v", s.skipped)
+
+	var u unexported
+	_assert(server.Register(&u) != nil, "expect an error for an unexported type")
+	_assert(server.RegisterName("Calc", &u) == nil, "expect RegisterName to accept any type")
+	_assert(server.RegisterName("Calc", &baz) != nil, "expect a duplicate service")
+
+	err = server.RegisterFunc("Calc.Mul", func(args Args, reply *int) error {
+		*reply = args.Num1 * args.Num2
+		return nil
+	})
+	_assert(err == nil, "failed to register a function: %v", err)
+	_assert(server.RegisterFunc("Calc.Bad", func(args Args) error { return nil }) != nil,
+		"expect a bad signature to be refused")
+
+	svc, mType, err := server.findService("Calc.Mul")
+	_assert(err == nil, "failed to find Calc.Mul: %v", err)
+	argv, replyv := mType.newArgv(), mType.newReplyv()
+	argv.Set(reflect.ValueOf(Args{Num1: 3, Num2: 4}))
+	err = svc.call(mType, argv, replyv)
+	_assert(err == nil && *replyv.Interface().(*int) == 12, "failed to call Calc.Mul")
+	_, _, err = server.findService("Calc.Sum")
+	_assert(err == nil, "expect the methods of the receiver to be kept")
+}
+
+// Qux sleeps Qux seconds before replying its own value.
+type Qux int
+
+func (q Qux) Get(args int, reply *int) error {
+	time.Sleep(time.Duration(q) * time.Second)
+	*reply = int(q)
+	return nil
+}
+
+func TestServer_Replace(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	server.SetMessageLimits(0, 64)
+	old := Qux(1)
+	_ = server.Register(&old)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var oldReply int
+	call := client.Go("Qux.Get", 0, &oldReply, nil)
+	time.Sleep(time.Millisecond * 100)
+	next := Qux(0)
+	_assert(server.Replace(&next) == nil, "failed to replace Qux")
+	var reply int
+	err = client.Call(context.Background(), "Qux.Get", 0, &reply)
+	_assert(err == nil && reply == 0, "expect the new implementation, got %d", reply)
+	<-call.Done
+	_assert(call.Error == nil && oldReply == 1, "expect the call in flight to finish on the old implementation")
+
+	_assert(server.Unregister("Qux") == nil, "failed to unregister Qux")
+	err = client.Call(context.Background(), "Qux.Get", 0, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find service"), "expect Qux to be gone")
+	_assert(server.Unregister("Qux") != nil, "expect an error for a missing service")
+	// the body of the failed call is skipped, so the connection goes on
+	_ = server.Register(&next)
+	err = client.Call(context.Background(), "Qux.Get", 0, &reply)
+	_assert(err == nil && reply == 0, "expect the connection to survive an unknown service, got %v", err)
+	err = client.Call(context.Background(), "Nope.Get", strings.Repeat("a", 1024), &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find service"), "expect Nope not to be found, got %v", err)
+	err = client.Call(context.Background(), "Qux.Get", 0, &reply)
+	_assert(err == nil, "expect the connection to survive a large body for an unknown service, got %v", err)
+
+	// the built-in services can't be taken over nor removed
+	err = server.RegisterName("Health", new(Qux))
+	_assert(err != nil && strings.Contains(err.Error(), "built-in"), "expect Health to be reserved, got %v", err)
+	_assert(server.RegisterName("Reflection", new(Qux)) != nil, "expect Reflection to be reserved")
+	err = server.RegisterName("MyHealth", new(Qux))
+	_assert(err == nil, "expect another name to be accepted, got %v", err)
+	_assert(server.Unregister("Health") != nil && server.ReplaceName("Health", new(Qux)) != nil &&
+		server.RegisterFunc("Reflection.Foo", func(int, *int) error { return nil }) != nil,
+		"expect the built-in services to be kept")
+	err = client.Call(context.Background(), "Health.Check", HealthCheckArgs{}, &HealthCheckReply{})
+	_assert(err == nil, "expect Health to still be served, got %v", err)
+}
@@ -0,0 +1,249 @@
+package registry
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminPath is the admin page, relative to the registry path, it lists the
+// instances and the recent events, and POSTs the admin actions to itself:
+//
+//	POST /admin   action=drain|undrain|remove|weight&namespace=N&addr=A&weight=W
+//
+// The actions aren't authenticated, the registry is expected to be served
+// on a trusted network, or behind an authenticating proxy. Actions posted
+// by the pages of other sites are refused, see sameOrigin.
+const adminPath = "/admin"
+
+// statusPath serves the Status of the registry as JSON, relative to the registry path.
+const statusPath = "/v1/status"
+
+// Status is the state of a registry shown by its admin page.
+type Status struct {
+	Revision  uint64           `json:"revision"`
+	Timeout   time.Duration    `json:"timeout"` // the default lease, 0 means never expire
+	Instances []InstanceStatus `json:"instances"`
+	Events    []Event          `json:"events"` // the most recent first
+}
+
+// InstanceStatus is an instance with its lease.
+type InstanceStatus struct {
+	ServerItem
+	Expires   time.Time     `json:"expires"`   // zero means never
+	ExpiresIn time.Duration `json:"expiresIn"` // the time to expiry, 0 means never
+}
+
+// Status returns the state of the registry, drained instances included.
+func (r *GeeRegistry) Status() Status {
+	alives, revision, _, _ := r.snapshot()
+	status := Status{Revision: revision, Timeout: r.timeout, Instances: make([]InstanceStatus, 0, len(alives))}
+	for i := range alives {
+		s := InstanceStatus{ServerItem: alives[i], Expires: r.expiry(&alives[i])}
+		if !s.Expires.IsZero() {
+			s.ExpiresIn = time.Until(s.Expires).Truncate(time.Millisecond)
+		}
+		status.Instances = append(status.Instances, s)
+	}
+	events := r.Events(0)
+	status.Events = make([]Event, 0, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		status.Events = append(status.Events, events[i])
+	}
+	return status
+}
+
+// adminUpdate applies fn to the server addr in namespace, it reports false when
+// it is unknown. The update renews the lease, so that it wins over the state
+// of the peers of a cluster.
+func (r *GeeRegistry) adminUpdate(namespace, addr string, fn func(s *ServerItem)) bool {
+	defer r.flush()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if validateNamespace(namespace) != nil {
+		return false
+	}
+	s := r.servers[instanceKey(namespace, addr)]
+	if s == nil || r.expired(s) {
+		return false
+	}
+	old := *s
+	fn(s)
+	s.LastHeartbeat = time.Now()
+	if !sameMetadata(&old, s) {
+		r.emit(EventUpdated, s)
+		r.save(s)
+	} else {
+		r.touch(s)
+	}
+	return true
+}
+
+// Drain stops listing the server addr in namespace to clients, it stays
+// registered until Undrain is called or it is removed.
+func (r *GeeRegistry) Drain(namespace, addr string) bool {
+	return r.adminUpdate(namespace, addr, func(s *ServerItem) { s.Drained = true })
+}
+
+// Undrain lists the server addr in namespace to clients again.
+func (r *GeeRegistry) Undrain(namespace, addr string) bool {
+	return r.adminUpdate(namespace, addr, func(s *ServerItem) { s.Drained = false })
+}
+
+// SetWeight replaces the weight the server addr in namespace publishes,
+// 0 gives the server its own weight back at its next heartbeat.
+func (r *GeeRegistry) SetWeight(namespace, addr string, weight int) bool {
+	return r.adminUpdate(namespace, addr, func(s *ServerItem) {
+		s.AdminWeight = weight
+		if weight > 0 {
+			s.Weight = weight
+		}
+	})
+}
+
+// Remove deregisters the server addr in namespace.
+func (r *GeeRegistry) Remove(namespace, addr string) bool {
+	return r.removeServer(namespace, addr)
+}
+
+// adminAction applies the action posted to the admin page.
+func (r *GeeRegistry) adminAction(req *http.Request) (int, error) {
+	namespace, addr := req.FormValue("namespace"), req.FormValue("addr")
+	if addr == "" {
+		return http.StatusBadRequest, fmt.Errorf("addr is required")
+	}
+	var ok bool
+	switch action := req.FormValue("action"); action {
+	case "drain":
+		ok = r.Drain(namespace, addr)
+	case "undrain":
+		ok = r.Undrain(namespace, addr)
+	case "remove":
+		ok = r.Remove(namespace, addr)
+	case "weight":
+		weight, err := strconv.Atoi(req.FormValue("weight"))
+		if err != nil || weight < 0 {
+			return http.StatusBadRequest, fmt.Errorf("invalid weight %q", req.FormValue("weight"))
+		}
+		ok = r.SetWeight(namespace, addr, weight)
+	default:
+		return http.StatusBadRequest, fmt.Errorf("unknown action %q", action)
+	}
+	if !ok {
+		return http.StatusNotFound, fmt.Errorf("no instance %s", addr)
+	}
+	return http.StatusOK, nil
+}
+
+// serveAdmin serves the admin page, and its actions: a browser is sent back
+// to the page, a client accepting JSON gets the new Status.
+func (r *GeeRegistry) serveAdmin(w http.ResponseWriter, req *http.Request) {
+	wantJSON := strings.Contains(req.Header.Get("Accept"), "application/json")
+	switch req.Method {
+	case "GET":
+		if wantJSON {
+			writeJSON(w, http.StatusOK, r.Status())
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := adminPage.Execute(w, r.Status()); err != nil {
+			_, _ = fmt.Fprintln(w, "rpc registry: error executing template:", err.Error())
+		}
+	case "POST":
+		if !sameOrigin(req) {
+			// a page of another site making the browser of the admin post an action
+			http.Error(w, "rpc registry: cross-site admin action refused", http.StatusForbidden)
+			return
+		}
+		code, err := r.adminAction(req)
+		switch {
+		case wantJSON && err != nil:
+			writeError(w, code, err.Error())
+		case wantJSON:
+			writeJSON(w, http.StatusOK, r.Status())
+		case err != nil:
+			http.Error(w, err.Error(), code)
+		default:
+			http.Redirect(w, req, req.URL.Path, http.StatusSeeOther)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, req.Method+" is not allowed")
+	}
+}
+
+// sameOrigin reports whether req doesn't come from a page of another site:
+// browsers send Sec-Fetch-Site, or at least Origin, with the POSTs of forms
+// and scripts. Requests with neither come from other clients, like curl.
+func sameOrigin(req *http.Request) bool {
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == req.Host
+}
+
+const adminText = `<html>
+	<body>
+	<title>GeeRPC Registry</title>
+	<h3>Instances (revision {{.Revision}}, default lease {{if .Timeout}}{{.Timeout}}{{else}}none{{end}})</h3>
+	<table>
+	<th align=center>Namespace</th><th align=center>Address</th><th align=center>Services</th>
+	<th align=center>Weight</th><th align=center>Zone</th><th align=center>Version</th><th align=center>Tags</th>
+	<th align=center>Registered</th><th align=center>Last heartbeat</th><th align=center>Expires in</th>
+	<th align=center>Actions</th>
+	{{range .Instances}}
+		<tr>
+		<td align=left>{{if .Namespace}}{{.Namespace}}{{else}}-{{end}}</td>
+		<td align=left font=fixed>{{.Addr}}{{if .Drained}} (drained){{end}}</td>
+		<td align=left>{{join .Services}}</td>
+		<td align=center>{{.Weight}}{{if .AdminWeight}} (set by admin){{end}}</td>
+		<td align=center>{{.Zone}}</td>
+		<td align=center>{{.Version}}</td>
+		<td align=left>{{join .Tags}}</td>
+		<td align=center>{{stamp .Registered}}</td>
+		<td align=center>{{stamp .LastHeartbeat}}</td>
+		<td align=center>{{if .ExpiresIn}}{{.ExpiresIn}}{{else}}never{{end}}</td>
+		<td align=left>
+			<form method=post style="display:inline">
+			<input type=hidden name=namespace value="{{.Namespace}}"><input type=hidden name=addr value="{{.Addr}}">
+			{{if .Drained}}<button name=action value=undrain>Undrain</button>{{else}}<button name=action value=drain>Drain</button>{{end}}
+			<button name=action value=remove>Remove</button>
+			<input name=weight size=4 value="{{.AdminWeight}}"><button name=action value=weight>Set weight</button>
+			</form>
+		</td>
+		</tr>
+	{{end}}
+	</table>
+	<h3>Recent events</h3>
+	<table>
+	<th align=center>#</th><th align=center>Time</th><th align=center>Event</th>
+	<th align=center>Namespace</th><th align=center>Address</th>
+	{{range .Events}}
+		<tr>
+		<td align=center>{{.Seq}}</td>
+		<td align=center>{{stamp .Time}}</td>
+		<td align=center>{{.Type}}</td>
+		<td align=left>{{if .Instance.Namespace}}{{.Instance.Namespace}}{{else}}-{{end}}</td>
+		<td align=left font=fixed>{{.Instance.Addr}}</td>
+		</tr>
+	{{end}}
+	</table>
+	</body>
+	</html>`
+
+var adminPage = template.Must(template.New("registry admin").Funcs(template.FuncMap{
+	"join":  func(s []string) string { return strings.Join(s, ", ") },
+	"stamp": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+}).Parse(adminText))
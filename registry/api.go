@@ -0,0 +1,244 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// apiPath is where the JSON API is served, relative to the registry path:
+//
+//	POST   /v1/instances                          register a ServerItem, or refresh it
+//	GET    /v1/instances?service=S&tag=T&zone=Z   list the alive instances, filters are optional
+//	GET    /v1/instances?watch=R&timeout=30s      like above, but wait until the revision differs from R
+//	GET    /v1/instances/<addr>                   get one instance, addr is path-escaped
+//	DELETE /v1/instances/<addr>                   deregister one instance
+//
+// Every request but POST is about the default namespace, unless a namespace
+// is given by ?namespace=N, the namespace * lists the instances of all of them.
+const apiPath = "/v1/instances"
+
+// AllNamespaces selects the instances of every namespace in a Filter.
+const AllNamespaces = "*"
+
+// InstanceList is the reply of listing instances.
+type InstanceList struct {
+	Revision  uint64       `json:"revision"` // changes whenever an instance changes, whatever the filters
+	Instances []ServerItem `json:"instances"`
+}
+
+const (
+	defaultWatchTimeout = time.Second * 30
+	maxWatchTimeout     = time.Minute * 2
+)
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// serveAPI serves the JSON API, rest is the escaped path after apiPath.
+func (r *GeeRegistry) serveAPI(w http.ResponseWriter, req *http.Request, rest string) {
+	addr, err := url.PathUnescape(strings.TrimPrefix(rest, "/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid address: "+err.Error())
+		return
+	}
+	switch {
+	case addr == "" && req.Method == "GET":
+		query := req.URL.Query()
+		var list InstanceList
+		var alives []ServerItem
+		if query.Has("watch") {
+			revision, timeout, err := parseWatch(query)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			alives, list.Revision = r.watch(req.Context(), revision, timeout)
+		} else {
+			alives, list.Revision, _, _ = r.snapshot()
+		}
+		list.Instances = filterServers(alives, filterFromQuery(query))
+		writeJSON(w, http.StatusOK, list)
+	case addr == "" && req.Method == "POST":
+		var item ServerItem
+		if err := json.NewDecoder(req.Body).Decode(&item); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid instance: "+err.Error())
+			return
+		}
+		if err := validate(&item); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, r.register(item))
+	case addr != "" && req.Method == "GET":
+		namespace := req.URL.Query().Get("namespace")
+		for _, s := range r.aliveServers() {
+			if s.Namespace == namespace && s.Addr == addr {
+				writeJSON(w, http.StatusOK, s)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "no instance "+addr)
+	case addr != "" && req.Method == "DELETE":
+		if !r.removeServer(req.URL.Query().Get("namespace"), addr) {
+			writeError(w, http.StatusNotFound, "no instance "+addr)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct{}{})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, req.Method+" is not allowed")
+	}
+}
+
+func parseWatch(query url.Values) (revision uint64, timeout time.Duration, err error) {
+	if revision, err = strconv.ParseUint(query.Get("watch"), 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid watch revision %q", query.Get("watch"))
+	}
+	timeout = defaultWatchTimeout
+	if t := query.Get("timeout"); t != "" {
+		if timeout, err = time.ParseDuration(t); err != nil || timeout <= 0 {
+			return 0, 0, fmt.Errorf("invalid watch timeout %q", t)
+		}
+	}
+	if timeout > maxWatchTimeout {
+		timeout = maxWatchTimeout
+	}
+	return revision, timeout, nil
+}
+
+func validate(item *ServerItem) error {
+	if err := validateNamespace(item.Namespace); err != nil {
+		return err
+	}
+	if item.Addr == "" {
+		return errors.New("addr is required")
+	}
+	if !strings.Contains(item.Addr, "@") {
+		return fmt.Errorf("addr %q must be formatted as protocol@addr", item.Addr)
+	}
+	if item.Weight < 0 {
+		return errors.New("weight must not be negative")
+	}
+	if item.TTL < 0 {
+		return errors.New("ttl must not be negative")
+	}
+	return nil
+}
+
+// validateNamespace accepts letters, digits, '-', '_' and '.'.
+func validateNamespace(namespace string) error {
+	for _, c := range namespace {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && !strings.ContainsRune("-_.", c) {
+			return fmt.Errorf("namespace %q must only contain letters, digits, '-', '_' and '.'", namespace)
+		}
+	}
+	return nil
+}
+
+// Filter selects instances: they must be in the namespace, offer all the
+// services and have all the tags, and have the zone and version unless they
+// are empty.
+type Filter struct {
+	Namespace string // empty means the default namespace, AllNamespaces means any
+	Services  []string
+	Tags      []string
+	Zone      string
+	Version   string
+}
+
+// filterFromQuery reads a Filter from the query of the JSON API, where service
+// and tag may be repeated.
+func filterFromQuery(query url.Values) Filter {
+	return Filter{
+		Namespace: query.Get("namespace"),
+		Services:  query["service"],
+		Tags:      query["tag"],
+		Zone:      query.Get("zone"),
+		Version:   query.Get("version"),
+	}
+}
+
+// Query encodes f as the query of the JSON API.
+func (f Filter) Query() url.Values {
+	query := url.Values{}
+	if f.Namespace != "" {
+		query.Set("namespace", f.Namespace)
+	}
+	for _, s := range f.Services {
+		query.Add("service", s)
+	}
+	for _, t := range f.Tags {
+		query.Add("tag", t)
+	}
+	if f.Zone != "" {
+		query.Set("zone", f.Zone)
+	}
+	if f.Version != "" {
+		query.Set("version", f.Version)
+	}
+	return query
+}
+
+// Match reports whether s is selected by f, drained servers never are.
+func (f Filter) Match(s *ServerItem) bool {
+	return !s.Drained && (f.Namespace == AllNamespaces || s.Namespace == f.Namespace) &&
+		contains(s.Services, f.Services) && contains(s.Tags, f.Tags) &&
+		(f.Zone == "" || s.Zone == f.Zone) &&
+		(f.Version == "" || s.Version == f.Version)
+}
+
+func filterServers(servers []ServerItem, f Filter) []ServerItem {
+	matched := make([]ServerItem, 0, len(servers))
+	for i := range servers {
+		if f.Match(&servers[i]) {
+			matched = append(matched, servers[i])
+		}
+	}
+	return matched
+}
+
+// contains reports whether all the wanted strings are in list.
+func contains(list, wanted []string) bool {
+	for _, w := range wanted {
+		found := false
+		for _, s := range list {
+			if s == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, apiError{Error: msg})
+}
+
+// checkResponse turns a reply of the JSON API which isn't 200 OK into an error.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var e apiError
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+		return fmt.Errorf("rpc registry: %s", resp.Status)
+	}
+	return fmt.Errorf("rpc registry: %s: %s", resp.Status, e.Error)
+}
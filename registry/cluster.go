@@ -0,0 +1,202 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// syncPath is where peers exchange their state, relative to the registry path.
+const syncPath = "/v1/sync"
+
+// minTombstoneTTL is how long a deregistration is remembered at least,
+// it must be longer than it takes to reach every peer.
+const minTombstoneTTL = time.Minute * 5
+
+// syncState is the state exchanged by peers.
+type syncState struct {
+	Servers    []ServerItem         `json:"servers"`
+	Tombstones map[string]time.Time `json:"tombstones,omitempty"` // by instanceKey
+}
+
+func (r *GeeRegistry) tombstoneTTL() time.Duration {
+	if r.timeout > minTombstoneTTL {
+		return r.timeout
+	}
+	return minTombstoneTTL
+}
+
+func (r *GeeRegistry) syncState() syncState {
+	alives := r.aliveServers()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state := syncState{Servers: alives, Tombstones: make(map[string]time.Time, len(r.tombstones))}
+	for addr, t := range r.tombstones {
+		state.Tombstones[addr] = t
+	}
+	return state
+}
+
+// merge keeps the most recent state of every server: a heartbeat more recent
+// than the deregistration known, or the other way around.
+func (r *GeeRegistry) merge(state syncState) {
+	defer r.flush()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, t := range state.Tombstones {
+		if s := r.servers[key]; s != nil && s.LastHeartbeat.Before(t) {
+			delete(r.servers, key)
+			r.forget(s)
+			r.emit(EventDeregistered, s)
+		}
+		if r.tombstones[key].Before(t) {
+			r.tombstones[key] = t
+		}
+	}
+	for _, item := range state.Servers {
+		if r.expired(&item) {
+			continue
+		}
+		key := item.key()
+		s := r.servers[key]
+		if (s != nil && !s.LastHeartbeat.Before(item.LastHeartbeat)) || !r.tombstones[key].Before(item.LastHeartbeat) {
+			continue
+		}
+		if s != nil && s.Registered.Before(item.Registered) {
+			item.Registered = s.Registered
+		}
+		delete(r.tombstones, key)
+		r.servers[key] = &item
+		switch {
+		case s == nil:
+			r.emit(EventRegistered, &item)
+			r.save(&item)
+		case !sameMetadata(s, &item):
+			r.emit(EventUpdated, &item)
+			r.save(&item)
+		default:
+			r.touch(&item)
+		}
+	}
+}
+
+// serveSync merges the state of a peer, and replies the merged state.
+func (r *GeeRegistry) serveSync(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, req.Method+" is not allowed")
+		return
+	}
+	var state syncState
+	if err := json.NewDecoder(req.Body).Decode(&state); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid state: "+err.Error())
+		return
+	}
+	r.merge(state)
+	writeJSON(w, http.StatusOK, r.syncState())
+}
+
+// Cluster replicates the servers of a GeeRegistry with peer registries by
+// gossip-based anti-entropy: every interval, and whenever the servers change,
+// it exchanges the whole state with every peer, and both sides keep the most
+// recent state of every server. Registrations survive the loss of a node as
+// long as one peer is left, and clients may use any node.
+type Cluster struct {
+	r        *GeeRegistry
+	peers    []string
+	interval time.Duration
+	client   *http.Client
+	cancel   context.CancelFunc
+	done     chan struct{} // closed when the sync loop has returned
+}
+
+var _ io.Closer = (*Cluster)(nil)
+
+const defaultSyncInterval = time.Second * 5
+
+// NewCluster starts replicating r with peers, the URLs their registries are
+// served at, every interval, 0 means 5 seconds.
+func NewCluster(r *GeeRegistry, peers []string, interval time.Duration) *Cluster {
+	if interval == 0 {
+		interval = defaultSyncInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Cluster{
+		r:        r,
+		peers:    peers,
+		interval: interval,
+		client:   &http.Client{Timeout: heartbeatTimeout},
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go c.loop(ctx)
+	return c
+}
+
+// Close stops replicating.
+func (c *Cluster) Close() error {
+	c.cancel()
+	<-c.done
+	return nil
+}
+
+func (c *Cluster) loop(ctx context.Context) {
+	defer close(c.done)
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+	for {
+		_, _, changed, _ := c.r.snapshot()
+		c.Sync(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-t.C:
+		}
+	}
+}
+
+// Sync exchanges the state with every peer now.
+func (c *Cluster) Sync(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, peer := range c.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.syncPeer(ctx, peer); err != nil && ctx.Err() == nil {
+				log.Println("rpc registry: sync with", peer, "error:", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (c *Cluster) syncPeer(ctx context.Context, peer string) error {
+	body, err := json.Marshal(c.r.syncState())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", peer+syncPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	var state syncState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return fmt.Errorf("rpc registry: invalid state of %s: %v", peer, err)
+	}
+	c.r.merge(state)
+	return nil
+}
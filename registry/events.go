@@ -0,0 +1,159 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// eventsPath is where the recent events are served, relative to the registry path:
+//
+//	GET /v1/events?after=S             the events after the sequence number S, 0 means all
+//	GET /v1/events?after=S&wait=30s    like above, but wait until there is one
+const eventsPath = "/v1/events"
+
+// maxEvents is how many recent events a registry keeps.
+const maxEvents = 100
+
+type EventType string
+
+const (
+	EventRegistered   EventType = "registered"
+	EventUpdated      EventType = "updated" // the metadata or the lease changed
+	EventDeregistered EventType = "deregistered"
+	EventExpired      EventType = "expired" // the lease ended without a heartbeat
+)
+
+// Event is a change of the instances of a registry.
+type Event struct {
+	Seq      uint64     `json:"seq"` // increases by one with every event
+	Type     EventType  `json:"type"`
+	Time     time.Time  `json:"time"`
+	Instance ServerItem `json:"instance"` // as it was after the event, or before its removal
+}
+
+// EventList is the reply of listing events.
+type EventList struct {
+	Events []Event `json:"events"`
+}
+
+// emit records an event of s and wakes up the watchers, r.mu must be held.
+func (r *GeeRegistry) emit(typ EventType, s *ServerItem) {
+	r.eventSeq++
+	if len(r.events) == maxEvents {
+		r.events = append(r.events[:0], r.events[1:]...)
+	}
+	r.events = append(r.events, Event{Seq: r.eventSeq, Type: typ, Time: time.Now(), Instance: *s})
+	r.notify()
+}
+
+// Events returns the recent events after the sequence number after, oldest first.
+func (r *GeeRegistry) Events(after uint64) []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []Event
+	for _, e := range r.events {
+		if e.Seq > after {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// watchEvents returns the events after the sequence number after once there
+// is one, or when timeout or ctx expires.
+func (r *GeeRegistry) watchEvents(ctx context.Context, after uint64, timeout time.Duration) []Event {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		// expires the servers, which emits their events
+		_, _, changed, _ := r.snapshot()
+		if events := r.Events(after); len(events) > 0 {
+			return events
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (r *GeeRegistry) serveEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, req.Method+" is not allowed")
+		return
+	}
+	query := req.URL.Query()
+	var after uint64
+	if a := query.Get("after"); a != "" {
+		var err error
+		if after, err = strconv.ParseUint(a, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid sequence number "+strconv.Quote(a))
+			return
+		}
+	}
+	list := EventList{Events: make([]Event, 0)}
+	if wait := query.Get("wait"); wait != "" {
+		timeout, err := time.ParseDuration(wait)
+		if err != nil || timeout <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid wait "+strconv.Quote(wait))
+			return
+		}
+		if timeout > maxWatchTimeout {
+			timeout = maxWatchTimeout
+		}
+		list.Events = append(list.Events, r.watchEvents(req.Context(), after, timeout)...)
+	} else {
+		list.Events = append(list.Events, r.Events(after)...)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// StartSweeper expires the servers in the background as soon as their lease
+// ends, instead of when the servers are next listed, so that watchers and
+// the store learn it on time. It runs until Close is called.
+func (r *GeeRegistry) StartSweeper() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sweeping {
+		return
+	}
+	r.sweeping = true
+	go r.sweep()
+}
+
+func (r *GeeRegistry) sweep() {
+	defer close(r.sweepDone)
+	for {
+		_, _, changed, nextExpiry := r.snapshot()
+		expired := time.NewTimer(time.Hour)
+		if !nextExpiry.IsZero() {
+			expired.Reset(time.Until(nextExpiry))
+		}
+		select {
+		case <-changed:
+		case <-expired.C:
+		case <-r.stopSweep:
+			expired.Stop()
+			return
+		}
+		expired.Stop()
+	}
+}
+
+// Close stops the sweeper, which can't be started again, and ends the
+// watches of the Registry service.
+func (r *GeeRegistry) Close() error {
+	r.closeOnce.Do(func() { close(r.stopSweep) })
+	r.mu.Lock()
+	sweeping := r.sweeping
+	r.mu.Unlock()
+	if sweeping {
+		<-r.sweepDone
+	}
+	return nil
+}
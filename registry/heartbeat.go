@@ -0,0 +1,237 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	heartbeatTimeout = time.Second * 5        // bounds a single request to a registry
+	minRetryDelay    = time.Millisecond * 100 // first retry after a failed heartbeat, doubled on every failure
+)
+
+// HeartbeatStatus tells how the heartbeats to a registry are going.
+type HeartbeatStatus struct {
+	Registry    string
+	LastSuccess time.Time // zero until a heartbeat succeeds
+	LastError   error     // error of the last heartbeat, nil when it succeeded
+	Failures    int       // consecutive failed heartbeats
+}
+
+// Heartbeater keeps a server registered to one or more registries: it sends
+// its ServerItem every interval, retries failed heartbeats with backoff, and
+// as every heartbeat is a full registration, a restarted registry learns the
+// server and its metadata again at the next one.
+type Heartbeater struct {
+	item       ServerItem
+	registries []string
+	interval   time.Duration
+	client     *http.Client
+	cancel     context.CancelFunc
+	done       chan struct{} // closed when the heartbeat loops have returned
+	stopOnce   sync.Once
+	mu         sync.Mutex // protect following
+	status     map[string]*HeartbeatStatus
+}
+
+// NewHeartbeater creates a Heartbeater of item, 0 interval renews the lease
+// of item three times per TTL, or leaves enough time to send a heartbeat
+// before the server is removed by a registry of default timeout.
+func NewHeartbeater(item ServerItem, interval time.Duration, registries ...string) *Heartbeater {
+	if interval == 0 && item.TTL > 0 {
+		interval = item.TTL / 3
+	}
+	if interval == 0 {
+		// make sure there is enough time to send heart beat
+		// before it's removed from registry
+		// 超时时间 减 1分钟
+		interval = defaultTimeout - time.Duration(1)*time.Minute
+	}
+	h := &Heartbeater{
+		item:       item,
+		registries: registries,
+		interval:   interval,
+		client:     &http.Client{Timeout: heartbeatTimeout},
+		status:     make(map[string]*HeartbeatStatus),
+	}
+	for _, registry := range registries {
+		h.status[registry] = &HeartbeatStatus{Registry: registry}
+	}
+	return h
+}
+
+// Start sends a first heartbeat to every registry and returns their errors,
+// then keeps sending heartbeats in the background until ctx is done or Stop
+// is called. Cancelling ctx doesn't deregister the server, Stop does.
+func (h *Heartbeater) Start(ctx context.Context) error {
+	ctx, h.cancel = context.WithCancel(ctx)
+	h.done = make(chan struct{})
+	errs := make([]error, len(h.registries))
+	var wg sync.WaitGroup
+	for i, registry := range h.registries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = h.beat(ctx, registry)
+		}()
+	}
+	wg.Wait()
+
+	for _, registry := range h.registries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.loop(ctx, registry)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(h.done)
+	}()
+	return errors.Join(errs...)
+}
+
+// Stop stops the heartbeats and deregisters the server from every registry,
+// later calls do nothing and return nil.
+func (h *Heartbeater) Stop() (err error) {
+	h.stopOnce.Do(func() {
+		if h.cancel != nil {
+			h.cancel()
+			<-h.done
+		}
+		errs := make([]error, 0, len(h.registries))
+		for _, registry := range h.registries {
+			errs = append(errs, h.deregister(context.Background(), registry))
+		}
+		err = errors.Join(errs...)
+	})
+	return err
+}
+
+// Status returns the heartbeat status of every registry, in the order they were given.
+func (h *Heartbeater) Status() []HeartbeatStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status := make([]HeartbeatStatus, 0, len(h.registries))
+	for _, registry := range h.registries {
+		status = append(status, *h.status[registry])
+	}
+	return status
+}
+
+// loop sends heartbeats to registry until ctx is done.
+func (h *Heartbeater) loop(ctx context.Context, registry string) {
+	t := time.NewTimer(h.nextDelay(registry))
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		_ = h.beat(ctx, registry)
+		t.Reset(h.nextDelay(registry))
+	}
+}
+
+// nextDelay is the interval after a success, and a growing, jittered delay
+// capped by the interval after failures.
+func (h *Heartbeater) nextDelay(registry string) time.Duration {
+	h.mu.Lock()
+	failures := h.status[registry].Failures
+	h.mu.Unlock()
+	if failures == 0 {
+		return h.interval
+	}
+	delay := h.interval
+	if failures < 30 && minRetryDelay<<(failures-1) < delay {
+		delay = minRetryDelay << (failures - 1)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// beat sends one heartbeat to registry and records how it went.
+func (h *Heartbeater) beat(ctx context.Context, registry string) error {
+	log.Println(h.item.Addr, "send heart beat to registry", registry)
+	err := h.register(ctx, registry)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.status[registry]
+	s.LastError = err
+	if err != nil {
+		s.Failures++
+		log.Println("rpc server: heart beat err:", err)
+	} else {
+		s.Failures = 0
+		s.LastSuccess = time.Now()
+	}
+	return err
+}
+
+func (h *Heartbeater) register(ctx context.Context, registry string) error {
+	body, err := json.Marshal(&h.item)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", registry+apiPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return do(h.client, req)
+}
+
+func (h *Heartbeater) deregister(ctx context.Context, registry string) error {
+	u := registry + apiPath + "/" + url.PathEscape(h.item.Addr)
+	if h.item.Namespace != "" {
+		u += "?" + Filter{Namespace: h.item.Namespace}.Query().Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+	return do(h.client, req)
+}
+
+// do sends a request of the JSON API and closes the response.
+func do(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	return checkResponse(resp)
+}
+
+// Heartbeat send a heartbeat message every once in a while
+// it's a helper function for a server to register or send heartbeat
+func Heartbeat(registry, addr string, duration time.Duration) *Heartbeater {
+	return WeightedHeartbeat(registry, addr, 0, duration)
+}
+
+// WeightedHeartbeat is like Heartbeat, and publishes the weight of the server
+// for weighted load balancing.
+func WeightedHeartbeat(registry, addr string, weight int, duration time.Duration) *Heartbeater {
+	h := NewHeartbeater(ServerItem{Addr: addr, Weight: weight}, duration, registry)
+	_ = h.Start(context.Background())
+	return h
+}
+
+// Register registers item to the registry through the JSON API, it also counts as a heartbeat.
+func Register(registry string, item ServerItem) error {
+	return NewHeartbeater(item, 0, registry).register(context.Background(), registry)
+}
+
+// Deregister removes the server addr of the default namespace from the registry,
+// so that clients stop picking it before its heartbeats time out.
+func Deregister(registry, addr string) error {
+	return NewHeartbeater(ServerItem{Addr: addr}, 0, registry).deregister(context.Background(), registry)
+}
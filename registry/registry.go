@@ -6,23 +6,75 @@ package registry
 // returns all alive servers and delete dead servers sync simultaneously.
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+// ServerItem is a server instance known by the registry.
 type ServerItem struct {
-	Addr  string
-	start time.Time
+	// Namespace isolates the instances of an environment or a team,
+	// e.g. dev, staging or prod, empty means the default namespace.
+	// The same address may be registered in several namespaces.
+	Namespace string `json:"namespace,omitempty"`
+
+	Addr     string   `json:"addr"`               // format protocol@addr, e.g. tcp@localhost:9999
+	Services []string `json:"services,omitempty"` // names of the services it serves
+	Weight   int      `json:"weight,omitempty"`   // used by weighted load balancing, 0 means not set
+	Zone     string   `json:"zone,omitempty"`
+	Version  string   `json:"version,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+
+	// TTL is the lease of the server: it expires TTL after its last heartbeat,
+	// 0 means the timeout of the registry. It is in nanoseconds in JSON.
+	TTL time.Duration `json:"ttl,omitempty"`
+
+	// Drained and AdminWeight are set by the admin of the registry, and kept
+	// across heartbeats: a drained server is no longer listed to clients, and
+	// AdminWeight, when not 0, replaces the weight the server publishes.
+	Drained     bool `json:"drained,omitempty"`
+	AdminWeight int  `json:"adminWeight,omitempty"`
+
+	Registered    time.Time `json:"registered"`    // when it was first seen
+	LastHeartbeat time.Time `json:"lastHeartbeat"` // set by the registry, renews the lease
+}
+
+// instanceKey identifies the instance at addr in namespace. Namespaces
+// can't contain '/', so the first one ends the namespace even when addr
+// has some, like unix@/tmp/geerpc.sock.
+func instanceKey(namespace, addr string) string {
+	return namespace + "/" + addr
+}
+
+func (s *ServerItem) key() string {
+	return instanceKey(s.Namespace, s.Addr)
 }
 
 type GeeRegistry struct {
-	timeout time.Duration
-	mu      sync.Mutex
-	servers map[string]*ServerItem
+	timeout  time.Duration
+	mu       sync.Mutex
+	servers  map[string]*ServerItem // by instanceKey
+	revision uint64                 // incremented whenever the list of servers or their metadata changes
+	changed  chan struct{}          // closed and replaced on every change
+	store    Store                  // where changes are saved, nil means nowhere
+	pending  []storeOp              // changes to write to store once r.mu is released, oldest first
+	flushing bool                   // whether a goroutine is writing pending to store
+	// when servers were deregistered, by instanceKey, so that peers of
+	// a cluster learn it instead of registering them again
+	tombstones map[string]time.Time
+	events     []Event       // the most recent ones, oldest first
+	eventSeq   uint64        // Seq of the last event
+	sweeping   bool          // whether StartSweeper was called
+	stopSweep  chan struct{} // closed by Close to stop the sweeper and the watches
+	closeOnce  sync.Once
+	sweepDone  chan struct{} // closed when the sweeper has returned
 }
 
 const (
@@ -34,47 +86,360 @@ var defaultGeeRegistry = NewGeeRegistry(defaultTimeout)
 
 func NewGeeRegistry(timeout time.Duration) *GeeRegistry {
 	return &GeeRegistry{
-		servers: make(map[string]*ServerItem),
-		timeout: timeout,
+		servers:    make(map[string]*ServerItem),
+		timeout:    timeout,
+		changed:    make(chan struct{}),
+		tombstones: make(map[string]time.Time),
+		stopSweep:  make(chan struct{}),
+		sweepDone:  make(chan struct{}),
+	}
+}
+
+// SetStore restores the servers saved in store, except the expired ones,
+// and saves every change to store from now on.
+func (r *GeeRegistry) SetStore(store Store) error {
+	items, err := store.Load()
+	if err != nil {
+		return err
+	}
+	defer r.flush()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.store = store
+	for _, item := range items {
+		// heartbeat times are absolute, so servers expire when they would have without a restart
+		if r.expired(&item) {
+			r.forget(&item)
+			continue
+		}
+		if s := r.servers[item.key()]; s == nil || s.LastHeartbeat.Before(item.LastHeartbeat) {
+			r.servers[item.key()] = &item
+		}
+	}
+	r.notify()
+	return nil
+}
+
+// storeOp is a change of the servers waiting to be written to the store.
+type storeOp struct {
+	item   ServerItem
+	delete bool
+	touch  bool // only the heartbeat time changed
+}
+
+// save queues s to be saved to the store, r.mu must be held.
+func (r *GeeRegistry) save(s *ServerItem) {
+	if r.store != nil {
+		r.pending = append(r.pending, storeOp{item: *s})
+	}
+}
+
+// touch queues the heartbeat of s to be recorded by the store, r.mu must be held.
+func (r *GeeRegistry) touch(s *ServerItem) {
+	if r.store != nil {
+		r.pending = append(r.pending, storeOp{item: *s, touch: true})
+	}
+}
+
+// forget queues s to be deleted from the store, r.mu must be held.
+func (r *GeeRegistry) forget(s *ServerItem) {
+	if r.store != nil {
+		r.pending = append(r.pending, storeOp{item: *s, delete: true})
+	}
+}
+
+// flush writes the queued changes to the store in order, r.mu must not be
+// held, so that a slow store doesn't block the registry. When another
+// goroutine is already flushing, it writes the changes instead.
+func (r *GeeRegistry) flush() {
+	r.mu.Lock()
+	if r.flushing {
+		r.mu.Unlock()
+		return
+	}
+	r.flushing = true
+	for len(r.pending) > 0 {
+		ops, store := r.pending, r.store
+		r.pending = nil
+		r.mu.Unlock()
+		writeOps(store, ops)
+		r.mu.Lock()
 	}
+	r.flushing = false
+	r.mu.Unlock()
+}
+
+func writeOps(store Store, ops []storeOp) {
+	for _, op := range ops {
+		var err error
+		switch {
+		case op.delete:
+			err = store.Delete(op.item.Namespace, op.item.Addr)
+		case op.touch:
+			err = store.Touch(op.item)
+		default:
+			err = store.Put(op.item)
+		}
+		if err != nil {
+			log.Println("rpc registry: store error:", err)
+		}
+	}
+}
+
+// notify records a change and wakes up the watchers, r.mu must be held.
+func (r *GeeRegistry) notify() {
+	r.revision++
+	close(r.changed)
+	r.changed = make(chan struct{})
 }
 
-func (r *GeeRegistry) putServer(addr string) {
+func (r *GeeRegistry) putServer(namespace, addr string, weight int, ttl time.Duration) {
+	defer r.flush()
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	s := r.servers[addr]
+	now := time.Now()
+	key := instanceKey(namespace, addr)
+	s := r.servers[key]
 	if s == nil {
-		r.servers[addr] = &ServerItem{
-			Addr:  addr,
-			start: time.Now(),
+		s = &ServerItem{
+			Namespace:     namespace,
+			Addr:          addr,
+			Weight:        weight,
+			TTL:           ttl,
+			Registered:    now,
+			LastHeartbeat: now,
 		}
+		r.servers[key] = s
+		r.emit(EventRegistered, s)
+		r.save(s)
 	} else {
-		s.start = time.Now()
+		s.LastHeartbeat = now
+		if s.AdminWeight > 0 {
+			weight = 0
+		}
+		if (weight > 0 && weight != s.Weight) || (ttl > 0 && ttl != s.TTL) {
+			if weight > 0 {
+				s.Weight = weight
+			}
+			if ttl > 0 {
+				s.TTL = ttl
+			}
+			r.emit(EventUpdated, s)
+			r.save(s)
+		} else {
+			r.touch(s)
+		}
 	}
 }
 
-func (r *GeeRegistry) aliveServers() []string {
+// register adds item, or replaces the metadata of the server with the same address,
+// it also counts as a heartbeat.
+func (r *GeeRegistry) register(item ServerItem) ServerItem {
+	defer r.flush()
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	var alives []string
-	for addr, s := range r.servers {
-		if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) {
-			alives = append(alives, addr)
-		} else {
-			delete(r.servers, addr)
+	now := time.Now()
+	item.Registered, item.LastHeartbeat = now, now
+	item.Drained, item.AdminWeight = false, 0
+	s := r.servers[item.key()]
+	if s != nil {
+		item.Registered = s.Registered
+		item.Drained, item.AdminWeight = s.Drained, s.AdminWeight
+		if item.AdminWeight > 0 {
+			item.Weight = item.AdminWeight
 		}
 	}
-	sort.Strings(alives)
+	r.servers[item.key()] = &item
+	switch {
+	case s == nil:
+		r.emit(EventRegistered, &item)
+		r.save(&item)
+	case !sameMetadata(s, &item):
+		r.emit(EventUpdated, &item)
+		r.save(&item)
+	default:
+		r.touch(&item)
+	}
+	return item
+}
+
+// heartbeat refreshes the server at addr in namespace, it reports false when it is unknown.
+func (r *GeeRegistry) heartbeat(namespace, addr string) (ServerItem, bool) {
+	defer r.flush()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if validateNamespace(namespace) != nil {
+		return ServerItem{}, false
+	}
+	s := r.servers[instanceKey(namespace, addr)]
+	if s == nil || r.expired(s) {
+		return ServerItem{}, false
+	}
+	s.LastHeartbeat = time.Now()
+	r.touch(s)
+	return *s, true
+}
+
+// ttl returns the lease of s, 0 means it never expires.
+func (r *GeeRegistry) ttl(s *ServerItem) time.Duration {
+	if s.TTL > 0 {
+		return s.TTL
+	}
+	return r.timeout
+}
+
+// expiry returns when the lease of s ends, zero means never.
+func (r *GeeRegistry) expiry(s *ServerItem) time.Time {
+	if ttl := r.ttl(s); ttl != 0 {
+		return s.LastHeartbeat.Add(ttl)
+	}
+	return time.Time{}
+}
+
+// expired reports whether s missed its heartbeats.
+func (r *GeeRegistry) expired(s *ServerItem) bool {
+	expiry := r.expiry(s)
+	return !expiry.IsZero() && !expiry.After(time.Now())
+}
+
+// sameMetadata reports whether a and b only differ by their times.
+func sameMetadata(a, b *ServerItem) bool {
+	x, y := *a, *b
+	x.Registered, x.LastHeartbeat, y.Registered, y.LastHeartbeat = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	return reflect.DeepEqual(x, y)
+}
+
+// removeServer removes the server addr in namespace, and reports whether it was known.
+func (r *GeeRegistry) removeServer(namespace, addr string) bool {
+	defer r.flush()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if validateNamespace(namespace) != nil {
+		return false
+	}
+	key := instanceKey(namespace, addr)
+	s, ok := r.servers[key]
+	if ok {
+		delete(r.servers, key)
+		r.tombstones[key] = time.Now()
+		r.forget(s)
+		r.emit(EventDeregistered, s)
+	}
+	return ok
+}
+
+// sortServers sorts servers by namespace and address.
+func sortServers(servers []ServerItem) {
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].Namespace != servers[j].Namespace {
+			return servers[i].Namespace < servers[j].Namespace
+		}
+		return servers[i].Addr < servers[j].Addr
+	})
+}
+
+// aliveServers returns copies of the alive servers sorted by namespace and address.
+func (r *GeeRegistry) aliveServers() []ServerItem {
+	alives, _, _, _ := r.snapshot()
 	return alives
 }
 
+// snapshot removes the dead servers, and returns the alive ones sorted by namespace and address,
+// the revision, the channel closed on the next change, and when the next server expires.
+func (r *GeeRegistry) snapshot() (alives []ServerItem, revision uint64, changed <-chan struct{}, nextExpiry time.Time) {
+	defer r.flush()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, s := range r.servers {
+		if r.expired(s) {
+			delete(r.servers, key)
+			r.forget(s)
+			r.emit(EventExpired, s)
+			continue
+		}
+		alives = append(alives, *s)
+		if expiry := r.expiry(s); !expiry.IsZero() && (nextExpiry.IsZero() || expiry.Before(nextExpiry)) {
+			nextExpiry = expiry
+		}
+	}
+	for addr, t := range r.tombstones {
+		if time.Since(t) > r.tombstoneTTL() {
+			delete(r.tombstones, addr)
+		}
+	}
+	sortServers(alives)
+	return alives, r.revision, r.changed, nextExpiry
+}
+
+// watch returns the alive servers once the revision differs from revision,
+// or when timeout or ctx expires.
+func (r *GeeRegistry) watch(ctx context.Context, revision uint64, timeout time.Duration) ([]ServerItem, uint64) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		alives, rev, changed, nextExpiry := r.snapshot()
+		if rev != revision {
+			return alives, rev
+		}
+		// wake up when a server expires, as nobody else may notice it
+		var expired <-chan time.Time
+		if !nextExpiry.IsZero() {
+			expired = time.After(time.Until(nextExpiry))
+		}
+		select {
+		case <-changed:
+		case <-expired:
+		case <-deadline.C:
+			return alives, rev
+		case <-ctx.Done():
+			return alives, rev
+		}
+	}
+}
+
+// ServeHTTP serves the JSON API under <registry path>/v1/, the admin page at
+// <registry path>/admin, and the header protocol at the registry path itself.
 func (r *GeeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// first, as an escaped address may end like another path
+	if i := strings.Index(req.URL.EscapedPath(), apiPath); i >= 0 {
+		r.serveAPI(w, req, req.URL.EscapedPath()[i+len(apiPath):])
+		return
+	}
+	switch path := req.URL.Path; {
+	case strings.HasSuffix(path, syncPath):
+		r.serveSync(w, req)
+		return
+	case strings.HasSuffix(path, eventsPath):
+		r.serveEvents(w, req)
+		return
+	case strings.HasSuffix(path, statusPath):
+		writeJSON(w, http.StatusOK, r.Status())
+		return
+	case strings.HasSuffix(path, adminPath):
+		r.serveAdmin(w, req)
+		return
+	}
+	// keep it simple, the namespace is in req.Header too, empty means the default one
+	namespace := req.Header.Get("X-Geerpc-Namespace")
 	switch req.Method {
 	case "GET":
 		// keep it simple, server is in req.Header
-		w.Header().Set("X-Geerpc-Servers", strings.Join(r.aliveServers(), ","))
+		alives := filterServers(r.aliveServers(), Filter{Namespace: namespace})
+		addrs := make([]string, 0, len(alives))
+		var weights []string
+		for _, s := range alives {
+			addrs = append(addrs, s.Addr)
+			if s.Weight > 0 {
+				weights = append(weights, fmt.Sprintf("%s=%d", s.Addr, s.Weight))
+			}
+		}
+		w.Header().Set("X-Geerpc-Servers", strings.Join(addrs, ","))
+		if len(weights) > 0 {
+			w.Header().Set("X-Geerpc-Weights", strings.Join(weights, ","))
+		}
 	case "POST":
 		// keep it simple, server is in req.Header
 		addr := req.Header.Get("X-Geerpc-Server")
@@ -82,7 +447,23 @@ func (r *GeeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		r.putServer(addr)
+		if validateNamespace(namespace) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		weight, _ := strconv.Atoi(req.Header.Get("X-Geerpc-Weight"))
+		ttl, _ := time.ParseDuration(req.Header.Get("X-Geerpc-TTL"))
+		r.putServer(namespace, addr, weight, ttl)
+	case "DELETE":
+		// keep it simple, server is in req.Header
+		addr := req.Header.Get("X-Geerpc-Server")
+		if addr == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !r.removeServer(namespace, addr) {
+			w.WriteHeader(http.StatusNotFound)
+		}
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
@@ -90,41 +471,16 @@ func (r *GeeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 func (r *GeeRegistry) HandleHTTP(registryPath string) {
 	http.Handle(registryPath, r)
+	http.Handle(registryPath+apiPath, r)
+	http.Handle(registryPath+apiPath+"/", r)
+	http.Handle(registryPath+syncPath, r)
+	http.Handle(registryPath+eventsPath, r)
+	http.Handle(registryPath+adminPath, r)
+	http.Handle(registryPath+statusPath, r)
+	r.StartSweeper()
 	log.Println("rpc registry path:", registryPath)
 }
 
 func HandleHTTP() {
 	defaultGeeRegistry.HandleHTTP(defaultPath)
 }
-
-// Heartbeat send a heartbeat message every once in a while
-// it's a helper function for a server to register or send heartbeat
-func Heartbeat(registry, addr string, duration time.Duration) {
-	if duration == 0 {
-		// make sure there is enough time to send heart beat
-		// before it's removed from registry
-		// 超时时间 减 1分钟
-		duration = defaultTimeout - time.Duration(1)*time.Minute
-	}
-	var err error
-	err = sendHeartbeat(registry, addr)
-	go func() {
-		t := time.NewTicker(duration)
-		for err == nil {
-			<-t.C
-			err = sendHeartbeat(registry, addr)
-		}
-	}()
-}
-
-func sendHeartbeat(registry, addr string) error {
-	log.Println(addr, "send heart beat to registry", registry)
-	httpClient := &http.Client{}
-	req, _ := http.NewRequest("POST", registry, nil)
-	req.Header.Set("X-Geerpc-Server", addr)
-	if _, err := httpClient.Do(req); err != nil {
-		log.Println("rpc server: heart beat err:", err)
-		return err
-	}
-	return nil
-}
@@ -0,0 +1,483 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"geerpc/geerpc"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+// startRegistry serves r at the default path and returns its URL.
+func startRegistry(t *testing.T, r *GeeRegistry) string {
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+	return ts.URL + defaultPath
+}
+
+func getJSON(t *testing.T, u string, v interface{}) int {
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_ = json.NewDecoder(resp.Body).Decode(v)
+	return resp.StatusCode
+}
+
+func TestGeeRegistry_API(t *testing.T) {
+	t.Parallel()
+	reg := startRegistry(t, NewGeeRegistry(time.Minute))
+	_assert(Register(reg, ServerItem{Addr: "tcp@a:1", Services: []string{"Foo", "Bar"}, Zone: "z1", Tags: []string{"canary"}}) == nil, "failed to register a")
+	_assert(Register(reg, ServerItem{Addr: "unix@/tmp/b.sock", Services: []string{"Foo"}, Weight: 3, Zone: "z2"}) == nil, "failed to register b")
+	err := Register(reg, ServerItem{Addr: "a:1"})
+	_assert(err != nil && strings.Contains(err.Error(), "protocol@addr"), "expect an invalid address to be refused, got %v", err)
+
+	var list InstanceList
+	getJSON(t, reg+apiPath+"?service=Foo", &list)
+	_assert(len(list.Instances) == 2, "expect 2 instances of Foo, got %v", list.Instances)
+	getJSON(t, reg+apiPath+"?service=Foo&tag=canary", &list)
+	_assert(len(list.Instances) == 1 && list.Instances[0].Addr == "tcp@a:1", "expect the canary, got %v", list.Instances)
+	getJSON(t, reg+apiPath+"?service=Bar&zone=z2", &list)
+	_assert(len(list.Instances) == 0, "expect no Bar in z2, got %v", list.Instances)
+
+	var item ServerItem
+	code := getJSON(t, reg+apiPath+"/"+url.PathEscape("unix@/tmp/b.sock"), &item)
+	_assert(code == http.StatusOK && item.Weight == 3 && !item.Registered.IsZero(), "expect instance b, got %d %+v", code, item)
+	code = getJSON(t, reg+apiPath+"/"+url.PathEscape("tcp@c:1"), &item)
+	_assert(code == http.StatusNotFound, "expect 404 for an unknown instance, got %d", code)
+
+	// the header protocol sees the same servers, and keeps their metadata
+	req, _ := http.NewRequest("POST", reg, nil)
+	req.Header.Set("X-Geerpc-Server", "tcp@a:1")
+	resp, err := http.DefaultClient.Do(req)
+	_assert(err == nil && resp.StatusCode == http.StatusOK, "failed to send a heartbeat")
+	_ = resp.Body.Close()
+	resp, err = http.Get(reg)
+	_assert(err == nil, "failed to get servers")
+	_ = resp.Body.Close()
+	_assert(resp.Header.Get("X-Geerpc-Servers") == "tcp@a:1,unix@/tmp/b.sock", "unexpected servers %q", resp.Header.Get("X-Geerpc-Servers"))
+	_assert(resp.Header.Get("X-Geerpc-Weights") == "unix@/tmp/b.sock=3", "unexpected weights %q", resp.Header.Get("X-Geerpc-Weights"))
+	getJSON(t, reg+apiPath+"/tcp@a:1", &item)
+	_assert(len(item.Services) == 2 && item.Zone == "z1", "expect the heartbeat to keep the metadata, got %+v", item)
+}
+
+func TestGeeRegistry_Deregister(t *testing.T) {
+	t.Parallel()
+	reg := startRegistry(t, NewGeeRegistry(time.Minute))
+	h := Heartbeat(reg, "tcp@a:1", time.Millisecond*10)
+	_ = Heartbeat(reg, "tcp@b:1", time.Minute)
+	var list InstanceList
+	getJSON(t, reg+apiPath, &list)
+	_assert(len(list.Instances) == 2, "expect 2 instances, got %v", list.Instances)
+
+	_assert(h.Stop() == nil, "failed to stop the heartbeat")
+	_assert(h.Stop() == nil, "expect Stop to be idempotent")
+	time.Sleep(time.Millisecond * 30) // a heartbeat would register a again
+	getJSON(t, reg+apiPath, &list)
+	_assert(len(list.Instances) == 1 && list.Instances[0].Addr == "tcp@b:1", "expect a to be gone, got %v", list.Instances)
+
+	err := Deregister(reg, "tcp@a:1")
+	_assert(err != nil && strings.Contains(err.Error(), "404"), "expect 404 for an unknown instance, got %v", err)
+	req, _ := http.NewRequest("DELETE", reg, nil)
+	req.Header.Set("X-Geerpc-Server", "tcp@b:1")
+	resp, err := http.DefaultClient.Do(req)
+	_assert(err == nil && resp.StatusCode == http.StatusOK, "expect the header protocol to deregister b")
+	_ = resp.Body.Close()
+	getJSON(t, reg+apiPath, &list)
+	_assert(len(list.Instances) == 0, "expect no instance, got %v", list.Instances)
+}
+
+func TestHeartbeater(t *testing.T) {
+	t.Parallel()
+	// the registry behind the URL can be replaced, as if it restarted
+	var current atomic.Pointer[GeeRegistry]
+	current.Store(NewGeeRegistry(time.Minute))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		current.Load().ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+	reg := ts.URL + defaultPath
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	h := NewHeartbeater(ServerItem{Addr: "tcp@a:1", Zone: "z1"}, time.Millisecond*20, reg, dead.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := h.Start(ctx)
+	_assert(err != nil && strings.Contains(err.Error(), dead.URL), "expect the dead registry to fail, got %v", err)
+
+	current.Store(NewGeeRegistry(time.Minute))
+	time.Sleep(time.Millisecond * 60)
+	var item ServerItem
+	code := getJSON(t, reg+apiPath+"/tcp@a:1", &item)
+	_assert(code == http.StatusOK && item.Zone == "z1", "expect the server to register again with its metadata, got %d", code)
+
+	status := h.Status()
+	_assert(len(status) == 2 && status[0].LastError == nil && !status[0].LastSuccess.IsZero(), "unexpected status %+v", status[0])
+	_assert(status[1].LastError != nil && status[1].Failures > 1 && status[1].LastSuccess.IsZero(), "unexpected status %+v", status[1])
+
+	err = h.Stop()
+	_assert(err != nil && strings.Contains(err.Error(), dead.URL) && !strings.Contains(err.Error(), ts.URL), "expect only the dead registry to fail, got %v", err)
+	code = getJSON(t, reg+apiPath+"/tcp@a:1", &item)
+	_assert(code == http.StatusNotFound, "expect Stop to deregister, got %d", code)
+	_assert(h.Stop() == nil, "expect Stop to be idempotent")
+}
+
+func TestFileStore(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, time.Hour)
+	_assert(err == nil, "failed to open the store: %v", err)
+	r := NewGeeRegistry(time.Minute)
+	_assert(r.SetStore(store) == nil, "failed to set the store")
+	r.register(ServerItem{Addr: "tcp@a:1", Zone: "z1"})
+	r.register(ServerItem{Addr: "tcp@b:1"})
+	before, _ := store.wal.Stat()
+	time.Sleep(time.Millisecond)
+	_, ok := r.heartbeat("", "tcp@a:1")
+	after, _ := store.wal.Stat()
+	_assert(ok && after.Size() == before.Size(), "expect a heartbeat not to be logged")
+	_assert(store.Snapshot() == nil, "failed to snapshot")
+	r.putServer("", "tcp@c:1", 2, 0)
+	r.removeServer("", "tcp@b:1")
+	// c stopped sending heartbeats long ago
+	_ = store.Put(ServerItem{Addr: "tcp@c:1", LastHeartbeat: time.Now().Add(-time.Hour)})
+	lastHeartbeat := r.aliveServers()[0].LastHeartbeat
+	_assert(store.wal.Close() == nil, "failed to close the log") // crash without a last snapshot
+
+	// a crash while writing leaves a torn record
+	f, _ := os.OpenFile(filepath.Join(dir, walFile), os.O_WRONLY|os.O_APPEND, 0644)
+	_, _ = f.WriteString(`{"put":{"addr":"tcp@d`)
+	_ = f.Close()
+
+	store, err = NewFileStore(dir, time.Hour)
+	_assert(err == nil, "failed to open the store again: %v", err)
+	defer func() { _ = store.Close() }()
+	r = NewGeeRegistry(time.Minute)
+	_assert(r.SetStore(store) == nil, "failed to restore")
+	alives := r.aliveServers()
+	_assert(len(alives) == 1 && alives[0].Addr == "tcp@a:1" && alives[0].Zone == "z1", "expect a only, got %v", alives)
+	_assert(alives[0].LastHeartbeat.Equal(lastHeartbeat), "expect the heartbeat time to be kept")
+	items, _ := store.Load()
+	_assert(len(items) == 1, "expect the expired server to be deleted from the store, got %v", items)
+}
+
+func TestCluster(t *testing.T) {
+	t.Parallel()
+	nodes := make([]*GeeRegistry, 3)
+	servers := make([]*httptest.Server, 3)
+	urls := make([]string, 3)
+	for i := range nodes {
+		nodes[i] = NewGeeRegistry(time.Minute)
+		servers[i] = httptest.NewServer(nodes[i])
+		defer servers[i].Close()
+		urls[i] = servers[i].URL + defaultPath
+	}
+	clusters := make([]*Cluster, 3)
+	for i := range nodes {
+		var peers []string
+		for j := range urls {
+			if j != i {
+				peers = append(peers, urls[j])
+			}
+		}
+		clusters[i] = NewCluster(nodes[i], peers, time.Millisecond*20)
+		defer func() { _ = clusters[i].Close() }()
+	}
+	has := func(r *GeeRegistry, addr string) bool {
+		for _, s := range r.aliveServers() {
+			if s.Addr == addr {
+				return true
+			}
+		}
+		return false
+	}
+	eventually := func(cond func() bool) bool {
+		for i := 0; i < 100; i++ {
+			if cond() {
+				return true
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		return false
+	}
+
+	_ = Register(urls[0], ServerItem{Addr: "tcp@a:1", Zone: "z1"})
+	_assert(eventually(func() bool { return has(nodes[1], "tcp@a:1") && has(nodes[2], "tcp@a:1") }),
+		"expect the registration to reach every node")
+	_assert(nodes[2].aliveServers()[0].Zone == "z1", "expect the metadata to be replicated")
+
+	_ = Deregister(urls[1], "tcp@a:1")
+	_assert(eventually(func() bool { return !has(nodes[0], "tcp@a:1") && !has(nodes[2], "tcp@a:1") }),
+		"expect the deregistration to reach every node")
+	time.Sleep(time.Millisecond * 50)
+	_assert(!has(nodes[0], "tcp@a:1"), "expect the deregistration not to be undone by a peer")
+
+	_ = Register(urls[0], ServerItem{Addr: "tcp@b:1"})
+	_assert(eventually(func() bool { return has(nodes[2], "tcp@b:1") }), "expect b to reach node 2")
+	_ = clusters[0].Close()
+	servers[0].Close()
+	_ = Register(urls[1], ServerItem{Addr: "tcp@c:1"})
+	_assert(eventually(func() bool { return has(nodes[2], "tcp@b:1") && has(nodes[2], "tcp@c:1") }),
+		"expect the cluster to survive the loss of node 0")
+}
+
+func TestGeeRegistry_Namespaces(t *testing.T) {
+	t.Parallel()
+	r := NewGeeRegistry(time.Minute)
+	store := NewMemoryStore()
+	_ = r.SetStore(store)
+	reg := startRegistry(t, r)
+	for _, ns := range []string{"", "dev", "prod"} {
+		_assert(Register(reg, ServerItem{Namespace: ns, Addr: "tcp@a:1", Services: []string{"Foo"}}) == nil,
+			"failed to register a in namespace %q", ns)
+	}
+	err := Register(reg, ServerItem{Namespace: "dev/x", Addr: "tcp@a:1"})
+	_assert(err != nil && strings.Contains(err.Error(), "namespace"), "expect an invalid namespace to be refused, got %v", err)
+
+	var list InstanceList
+	getJSON(t, reg+apiPath, &list)
+	_assert(len(list.Instances) == 1 && list.Instances[0].Namespace == "", "expect the default namespace only, got %v", list.Instances)
+	getJSON(t, reg+apiPath+"?namespace=dev&service=Foo", &list)
+	_assert(len(list.Instances) == 1 && list.Instances[0].Namespace == "dev", "expect dev only, got %v", list.Instances)
+	getJSON(t, reg+apiPath+"?namespace=*", &list)
+	_assert(len(list.Instances) == 3, "expect every namespace, got %v", list.Instances)
+
+	// an address which looks like a namespace and an address doesn't collide with them
+	r.register(ServerItem{Addr: "dev/tcp@a:1"})
+	getJSON(t, reg+apiPath+"?namespace=*", &list)
+	_assert(len(list.Instances) == 4, "expect dev/tcp@a:1 to be a fourth instance, got %v", list.Instances)
+	_assert(r.removeServer("", "dev/tcp@a:1"), "failed to remove dev/tcp@a:1")
+	_, ok := r.heartbeat("dev", "tcp@a:1")
+	_assert(ok, "expect a to be left in dev")
+
+	h := NewHeartbeater(ServerItem{Namespace: "dev", Addr: "tcp@a:1"}, time.Minute, reg)
+	_assert(h.deregister(context.Background(), reg) == nil, "failed to deregister a from dev")
+	getJSON(t, reg+apiPath+"?namespace=*", &list)
+	_assert(len(list.Instances) == 2, "expect a to be left in the other namespaces, got %v", list.Instances)
+	items, _ := store.Load()
+	_assert(len(items) == 2 && items[0].Namespace == "" && items[1].Namespace == "prod", "expect the store to follow, got %v", items)
+
+	// the header protocol is scoped by X-Geerpc-Namespace
+	req, _ := http.NewRequest("GET", reg, nil)
+	req.Header.Set("X-Geerpc-Namespace", "prod")
+	resp, err := http.DefaultClient.Do(req)
+	_assert(err == nil && resp.Header.Get("X-Geerpc-Servers") == "tcp@a:1", "expect a in prod")
+	_ = resp.Body.Close()
+	req.Header.Set("X-Geerpc-Namespace", "dev")
+	resp, err = http.DefaultClient.Do(req)
+	_assert(err == nil && resp.Header.Get("X-Geerpc-Servers") == "", "expect dev to be empty")
+	_ = resp.Body.Close()
+}
+
+func TestGeeRegistry_Leases(t *testing.T) {
+	t.Parallel()
+	r := NewGeeRegistry(time.Minute)
+	r.StartSweeper()
+	defer func() { _ = r.Close() }()
+	reg := startRegistry(t, r)
+	_ = Register(reg, ServerItem{Addr: "tcp@a:1", TTL: time.Millisecond * 50})
+	_ = Register(reg, ServerItem{Addr: "tcp@b:1"})
+	_ = Register(reg, ServerItem{Addr: "tcp@c:1", TTL: time.Millisecond * 150})
+	for i := 0; i < 5; i++ {
+		time.Sleep(time.Millisecond * 20)
+		_ = Register(reg, ServerItem{Addr: "tcp@c:1", TTL: time.Millisecond * 150})
+	}
+
+	// the sweeper expires a without anybody listing the servers
+	events := r.Events(0)
+	_assert(len(events) == 4, "expect 3 registrations and an expiry, got %v", events)
+	_assert(events[3].Type == EventExpired && events[3].Instance.Addr == "tcp@a:1", "expect a to expire, got %v", events[3])
+	var list InstanceList
+	getJSON(t, reg+apiPath, &list)
+	_assert(len(list.Instances) == 2, "expect the heartbeats to renew the lease of c, got %v", list.Instances)
+
+	// c expires once its heartbeats stop, which wakes up the events watchers
+	var el EventList
+	start := time.Now()
+	getJSON(t, fmt.Sprintf("%s%s?after=%d&wait=1s", reg, eventsPath, events[3].Seq), &el)
+	_assert(len(el.Events) == 1 && el.Events[0].Type == EventExpired && el.Events[0].Instance.Addr == "tcp@c:1",
+		"expect c to expire, got %v", el.Events)
+	_assert(time.Since(start) < time.Millisecond*500, "expect the watch to return on the expiry")
+	err := Register(reg, ServerItem{Addr: "tcp@d:1", TTL: -time.Second})
+	_assert(err != nil && strings.Contains(err.Error(), "ttl"), "expect a negative ttl to be refused, got %v", err)
+}
+
+func TestGeeRegistry_Admin(t *testing.T) {
+	t.Parallel()
+	reg := startRegistry(t, NewGeeRegistry(time.Minute))
+	_ = Register(reg, ServerItem{Addr: "tcp@a:1", Weight: 2})
+	_ = Register(reg, ServerItem{Addr: "tcp@b:1", Weight: 1})
+	post := func(form url.Values) (int, Status) {
+		req, _ := http.NewRequest("POST", reg+adminPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		var status Status
+		_ = json.NewDecoder(resp.Body).Decode(&status)
+		return resp.StatusCode, status
+	}
+	weightOf := func(addr string) int {
+		var item ServerItem
+		getJSON(t, reg+apiPath+"/"+url.PathEscape(addr), &item)
+		return item.Weight
+	}
+
+	code, status := post(url.Values{"action": {"drain"}, "addr": {"tcp@a:1"}})
+	_assert(code == http.StatusOK && status.Instances[0].Drained, "expect a to be drained, got %d %v", code, status.Instances)
+	_ = Register(reg, ServerItem{Addr: "tcp@a:1", Weight: 2})
+	var list InstanceList
+	getJSON(t, reg+apiPath, &list)
+	_assert(len(list.Instances) == 1 && list.Instances[0].Addr == "tcp@b:1", "expect drained a to stay hidden, got %v", list.Instances)
+
+	// a browser is sent back to the page
+	resp, err := http.PostForm(reg+adminPath, url.Values{"action": {"weight"}, "addr": {"tcp@b:1"}, "weight": {"7"}})
+	_assert(err == nil && resp.StatusCode == http.StatusOK && resp.Request.Method == "GET", "expect a redirect to the page")
+	page, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	_assert(strings.Contains(string(page), "tcp@a:1 (drained)") && strings.Contains(string(page), "set by admin"),
+		"expect the page to show the admin actions, got %s", page)
+	_ = Register(reg, ServerItem{Addr: "tcp@b:1", Weight: 1})
+	_assert(weightOf("tcp@b:1") == 7, "expect the admin weight to survive heartbeats")
+	post(url.Values{"action": {"weight"}, "addr": {"tcp@b:1"}, "weight": {"0"}})
+	_ = Register(reg, ServerItem{Addr: "tcp@b:1", Weight: 1})
+	_assert(weightOf("tcp@b:1") == 1, "expect the own weight of b back")
+
+	code, status = post(url.Values{"action": {"remove"}, "addr": {"tcp@a:1"}})
+	_assert(code == http.StatusOK && len(status.Instances) == 1, "expect a to be removed, got %v", status.Instances)
+	code, _ = post(url.Values{"action": {"drain"}, "addr": {"tcp@a:1"}})
+	_assert(code == http.StatusNotFound, "expect 404 for an unknown instance, got %d", code)
+
+	getJSON(t, reg+statusPath, &status)
+	_assert(status.Instances[0].ExpiresIn > 0 && status.Instances[0].ExpiresIn <= time.Minute, "expect the time to expiry, got %v", status.Instances[0])
+	_assert(status.Events[0].Type == EventDeregistered && status.Events[0].Instance.Addr == "tcp@a:1", "expect the most recent event first, got %v", status.Events[0])
+
+	// the pages of other sites can't post actions
+	u, _ := url.Parse(reg)
+	for _, tc := range []struct {
+		header, value string
+		code          int
+	}{
+		{"Origin", "http://evil.example", http.StatusForbidden},
+		{"Origin", "null", http.StatusForbidden},
+		{"Sec-Fetch-Site", "cross-site", http.StatusForbidden},
+		{"Sec-Fetch-Site", "same-site", http.StatusForbidden},
+		{"Origin", "http://" + u.Host, http.StatusOK},
+		{"Sec-Fetch-Site", "same-origin", http.StatusOK},
+	} {
+		form := url.Values{"action": {"drain"}, "addr": {"tcp@b:1"}}
+		req, _ := http.NewRequest("POST", reg+adminPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set(tc.header, tc.value)
+		resp, err := http.DefaultClient.Do(req)
+		_assert(err == nil && resp.StatusCode == tc.code, "expect %d for %s: %s, got %v", tc.code, tc.header, tc.value, resp.StatusCode)
+		_ = resp.Body.Close()
+	}
+}
+
+func TestService_Watch(t *testing.T) {
+	t.Parallel()
+	r := NewGeeRegistry(time.Minute)
+	server := geerpc.NewServer()
+	_ = r.RegisterService(server)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	client, err := geerpc.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	// a watch doesn't delay the shutdown of the server
+	var list InstanceList
+	watched := make(chan error, 1)
+	go func() {
+		watched <- client.Call(context.Background(), "Registry.Watch", WatchArgs{Timeout: time.Minute}, &list)
+	}()
+	time.Sleep(time.Millisecond * 50)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	start := time.Now()
+	_assert(server.Shutdown(ctx) == nil && time.Since(start) < time.Second, "expect the watch to end on shutdown")
+	_assert(<-watched == nil, "expect the watch to return the instances")
+
+	// nor does it outlive the registry
+	s := NewService(r)
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		_ = r.Close()
+	}()
+	start = time.Now()
+	_assert(s.Watch(WatchArgs{Timeout: time.Minute}, &list) == nil && time.Since(start) < time.Second,
+		"expect the watch to end when the registry is closed")
+}
+
+// blockingStore counts the writes, and blocks Put until unblock is closed.
+type blockingStore struct {
+	MemoryStore
+	puts, touches int32
+	unblock       chan struct{}
+}
+
+func (s *blockingStore) Put(item ServerItem) error {
+	atomic.AddInt32(&s.puts, 1)
+	<-s.unblock
+	return s.MemoryStore.Put(item)
+}
+
+func (s *blockingStore) Touch(item ServerItem) error {
+	atomic.AddInt32(&s.touches, 1)
+	return s.MemoryStore.Touch(item)
+}
+
+func TestGeeRegistry_StoreWrites(t *testing.T) {
+	t.Parallel()
+	store := &blockingStore{MemoryStore: *NewMemoryStore(), unblock: make(chan struct{})}
+	r := NewGeeRegistry(time.Minute)
+	_ = r.SetStore(store)
+
+	// a slow store doesn't block the registry
+	registered := make(chan struct{})
+	go func() {
+		r.register(ServerItem{Addr: "tcp@a:1"})
+		close(registered)
+	}()
+	for atomic.LoadInt32(&store.puts) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_assert(len(r.aliveServers()) == 1, "expect the registry to be readable while the store writes")
+	close(store.unblock)
+	<-registered
+
+	// refreshes are touches, only changes are put
+	r.register(ServerItem{Addr: "tcp@a:1"})
+	r.putServer("", "tcp@a:1", 0, 0)
+	_, ok := r.heartbeat("", "tcp@a:1")
+	_assert(ok && store.puts == 1 && store.touches == 3, "expect 1 put and 3 touches, got %d and %d", store.puts, store.touches)
+	r.register(ServerItem{Addr: "tcp@a:1", Zone: "z1"})
+	_assert(store.puts == 2, "expect a change of metadata to be put, got %d puts", store.puts)
+	items, _ := store.Load()
+	_assert(len(items) == 1 && items[0].Zone == "z1", "expect the store to follow the registry, got %v", items)
+}
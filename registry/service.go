@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"geerpc/geerpc"
+	"time"
+)
+
+// ServiceName is the name the Registry service is registered under.
+const ServiceName = "Registry"
+
+// Service offers a GeeRegistry as a GeeRPC service, so that the registry and
+// the RPC services can be served on one port with one codec:
+//
+//	Registry.Register    register a ServerItem, or replace its metadata
+//	Registry.Deregister  deregister an instance
+//	Registry.Heartbeat   refresh a registered instance
+//	Registry.List        list the alive instances matching a Filter
+//	Registry.Watch       like List, but wait until the revision differs
+type Service struct {
+	r    *GeeRegistry
+	done <-chan struct{} // closed when the server shuts down, nil means never
+}
+
+type DeregisterArgs struct {
+	Namespace string // empty means the default namespace
+	Addr      string
+}
+
+type HeartbeatArgs struct {
+	Namespace string // empty means the default namespace
+	Addr      string
+}
+
+type WatchArgs struct {
+	Filter
+	Revision uint64        // the revision known by the caller, Watch returns once it differs
+	Timeout  time.Duration // 0 means 30 seconds, at most 2 minutes
+}
+
+// NewService creates the Registry service of r.
+func NewService(r *GeeRegistry) *Service {
+	return &Service{r: r}
+}
+
+// RegisterService registers the Registry service of r on server.
+func (r *GeeRegistry) RegisterService(server *geerpc.Server) error {
+	s := NewService(r)
+	s.done = server.Done()
+	return server.RegisterName(ServiceName, s)
+}
+
+func (s *Service) MethodOptions() map[string]geerpc.MethodOptions {
+	return map[string]geerpc.MethodOptions{
+		"Register":   {Idempotent: true},
+		"Deregister": {Idempotent: true},
+		"Heartbeat":  {Idempotent: true},
+		"List":       {Idempotent: true},
+		// a watch outlives the handle timeout of the server
+		"Watch": {Idempotent: true, Timeout: maxWatchTimeout + time.Second*10},
+	}
+}
+
+func (s *Service) Register(item ServerItem, reply *ServerItem) error {
+	if err := validate(&item); err != nil {
+		return errors.New("rpc registry: " + err.Error())
+	}
+	*reply = s.r.register(item)
+	return nil
+}
+
+func (s *Service) Deregister(args DeregisterArgs, reply *bool) error {
+	if !s.r.removeServer(args.Namespace, args.Addr) {
+		return errors.New("rpc registry: no instance " + args.Addr)
+	}
+	*reply = true
+	return nil
+}
+
+// Heartbeat fails for an unknown instance, which is expected to register again.
+func (s *Service) Heartbeat(args HeartbeatArgs, reply *ServerItem) error {
+	item, ok := s.r.heartbeat(args.Namespace, args.Addr)
+	if !ok {
+		return errors.New("rpc registry: no instance " + args.Addr)
+	}
+	*reply = item
+	return nil
+}
+
+func (s *Service) List(args Filter, reply *InstanceList) error {
+	alives, revision, _, _ := s.r.snapshot()
+	reply.Revision, reply.Instances = revision, filterServers(alives, args)
+	return nil
+}
+
+// Watch returns early when the server shuts down or the registry is closed.
+func (s *Service) Watch(args WatchArgs, reply *InstanceList) error {
+	timeout := args.Timeout
+	if timeout <= 0 {
+		timeout = defaultWatchTimeout
+	}
+	if timeout > maxWatchTimeout {
+		timeout = maxWatchTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+		case <-s.r.stopSweep:
+		case <-ctx.Done():
+			return
+		}
+		cancel()
+	}()
+	alives, revision := s.r.watch(ctx, args.Revision, timeout)
+	reply.Revision, reply.Instances = revision, filterServers(alives, args.Filter)
+	return nil
+}
@@ -0,0 +1,297 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Store persists the servers of a GeeRegistry, so that a restarted registry
+// knows them before their next heartbeat, see GeeRegistry.SetStore.
+type Store interface {
+	// Load returns the servers saved, expired ones included.
+	Load() ([]ServerItem, error)
+	// Put saves a new server, or the new state of a server.
+	Put(item ServerItem) error
+	// Touch records a heartbeat of a saved server, only the heartbeat
+	// time differs from the last Put. It may be lost on a crash.
+	Touch(item ServerItem) error
+	// Delete forgets the server addr in namespace.
+	Delete(namespace, addr string) error
+}
+
+// MemoryStore keeps the servers in memory, e.g. to share them between registries of one process.
+type MemoryStore struct {
+	mu      sync.Mutex
+	servers map[string]ServerItem // by instanceKey
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{servers: make(map[string]ServerItem)}
+}
+
+func (s *MemoryStore) Load() ([]ServerItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedItems(s.servers), nil
+}
+
+func (s *MemoryStore) Put(item ServerItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servers[item.key()] = item
+	return nil
+}
+
+func (s *MemoryStore) Touch(item ServerItem) error {
+	return s.Put(item)
+}
+
+func (s *MemoryStore) Delete(namespace, addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.servers, instanceKey(namespace, addr))
+	return nil
+}
+
+func sortedItems(servers map[string]ServerItem) []ServerItem {
+	items := make([]ServerItem, 0, len(servers))
+	for _, item := range servers {
+		items = append(items, item)
+	}
+	sortServers(items)
+	return items
+}
+
+const (
+	snapshotFile            = "snapshot.json"
+	walFile                 = "wal.log"
+	defaultSnapshotInterval = time.Minute
+)
+
+// FileStore saves the servers in a directory on the local disk: every change
+// is appended to a write-ahead log, and the log is compacted into a snapshot
+// every snapshot interval. Loading reads the snapshot, then replays the log.
+// Heartbeats are only written by the snapshots, so a crash loses at most
+// one interval of them.
+type FileStore struct {
+	dir     string
+	mu      sync.Mutex // protect following
+	servers map[string]ServerItem
+	wal     *os.File
+	dirty   bool // the log has records not in the snapshot
+	stop    chan struct{}
+	done    chan struct{} // closed when the snapshot loop has returned
+}
+
+var _ Store = (*FileStore)(nil)
+var _ io.Closer = (*FileStore)(nil)
+
+// walRecord is a line of the write-ahead log.
+type walRecord struct {
+	Put    *ServerItem `json:"put,omitempty"`
+	Delete string      `json:"delete,omitempty"` // instanceKey of the server
+}
+
+// NewFileStore opens the store in dir, creating it when needed, and snapshots
+// it every interval, 0 means one minute. Close takes a last snapshot.
+func NewFileStore(dir string, interval time.Duration) (*FileStore, error) {
+	if interval == 0 {
+		interval = defaultSnapshotInterval
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &FileStore{
+		dir:     dir,
+		servers: make(map[string]ServerItem),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := s.restore(); err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.wal = wal
+	go s.snapshotLoop(interval)
+	return s, nil
+}
+
+// restore reads the snapshot and replays the log.
+func (s *FileStore) restore() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 {
+		var items []ServerItem
+		if err := json.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		for _, item := range items {
+			s.servers[item.key()] = item
+		}
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, walFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var rec walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// the last record may be torn by a crash while it was written
+			log.Println("rpc registry: skip a broken record of", f.Name(), err)
+			continue
+		}
+		s.dirty = true
+		if rec.Put != nil {
+			s.servers[rec.Put.key()] = *rec.Put
+		} else {
+			delete(s.servers, rec.Delete)
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *FileStore) Load() ([]ServerItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedItems(s.servers), nil
+}
+
+func (s *FileStore) Put(item ServerItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servers[item.key()] = item
+	return s.append(walRecord{Put: &item})
+}
+
+// Touch keeps the heartbeat for the next snapshot, without writing the log.
+func (s *FileStore) Touch(item ServerItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wal == nil {
+		return errors.New("rpc registry: store closed")
+	}
+	s.servers[item.key()] = item
+	s.dirty = true
+	return nil
+}
+
+func (s *FileStore) Delete(namespace, addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := instanceKey(namespace, addr)
+	delete(s.servers, key)
+	return s.append(walRecord{Delete: key})
+}
+
+// append writes rec to the log, s.mu must be held.
+func (s *FileStore) append(rec walRecord) error {
+	if s.wal == nil {
+		return errors.New("rpc registry: store closed")
+	}
+	line, err := json.Marshal(&rec)
+	if err != nil {
+		return err
+	}
+	s.dirty = true
+	if _, err = s.wal.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+func (s *FileStore) snapshotLoop(interval time.Duration) {
+	defer close(s.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			if err := s.Snapshot(); err != nil {
+				log.Println("rpc registry: snapshot error:", err)
+			}
+		}
+	}
+}
+
+// Snapshot writes all the servers to the snapshot file and empties the log.
+func (s *FileStore) Snapshot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty || s.wal == nil {
+		return nil
+	}
+	data, err := json.Marshal(sortedItems(s.servers))
+	if err != nil {
+		return err
+	}
+	// write aside and rename, so a crash leaves either snapshot whole
+	tmp := filepath.Join(s.dir, snapshotFile+".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return err
+	}
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func writeFileSync(name string, data []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Close takes a last snapshot and closes the log.
+func (s *FileStore) Close() error {
+	select {
+	case <-s.stop:
+		return nil
+	default:
+	}
+	close(s.stop)
+	<-s.done
+	err := s.Snapshot()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cerr := s.wal.Close(); err == nil {
+		err = cerr
+	}
+	s.wal = nil
+	return err
+}
@@ -1,3 +1,5 @@
+//go:generate go run geerpc/cmd/geerpc-gen -type CalcService -o calc_geerpc.go
+
 package Test
 
 import (
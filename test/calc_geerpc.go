@@ -0,0 +1,52 @@
+// Code generated by geerpc-gen. DO NOT EDIT.
+
+package Test
+
+import (
+	"context"
+
+	"geerpc/geerpc"
+)
+
+// CalcServiceClient is a typed client of the CalcService service, it calls through
+// a *geerpc.Client or a *xclient.XClient.
+type CalcServiceClient struct {
+	c geerpc.Caller
+}
+
+func NewCalcServiceClient(c geerpc.Caller) *CalcServiceClient {
+	return &CalcServiceClient{c: c}
+}
+
+// Add calls CalcService.Add.
+func (c *CalcServiceClient) Add(ctx context.Context, args *CArgs) (int, error) {
+	var reply int
+	err := c.c.Call(ctx, "CalcService.Add", args, &reply)
+	return reply, err
+}
+
+// Div calls CalcService.Div.
+func (c *CalcServiceClient) Div(ctx context.Context, args *CArgs) (int, error) {
+	var reply int
+	err := c.c.Call(ctx, "CalcService.Div", args, &reply)
+	return reply, err
+}
+
+// Mul calls CalcService.Mul.
+func (c *CalcServiceClient) Mul(ctx context.Context, args *CArgs) (int, error) {
+	var reply int
+	err := c.c.Call(ctx, "CalcService.Mul", args, &reply)
+	return reply, err
+}
+
+// Sub calls CalcService.Sub.
+func (c *CalcServiceClient) Sub(ctx context.Context, args *CArgs) (int, error) {
+	var reply int
+	err := c.c.Call(ctx, "CalcService.Sub", args, &reply)
+	return reply, err
+}
+
+// RegisterCalcService registers svc as the CalcService service of server.
+func RegisterCalcService(server *geerpc.Server, svc *CalcService) error {
+	return server.Register(svc)
+}
@@ -51,7 +51,7 @@ func demoXClientAsync(registryAddr string) {
 
 	// 创建XClient
 	discovery := xclient.NewGeeRegistryDiscovery(registryAddr, 0)
-	xc := xclient.NewXClient(discovery, xclient.RandomSelect, nil)
+	xc := xclient.NewXClient(discovery, xclient.RandomSelect, xclient.Failfast, nil)
 	defer xc.Close()
 
 	// 示例1: 使用Go方法
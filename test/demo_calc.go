@@ -52,7 +52,7 @@ func DemoCalc() {
 
 	d := xclient.NewGeeRegistryDiscovery(registryPath, 0) // 服务发现registryPath的注册中心发送HTTP报文发现服务
 
-	xc := xclient.NewXClient(d, xclient.RandomSelect, nil) //
+	xc := xclient.NewXClient(d, xclient.RandomSelect, xclient.Failfast, nil) //
 	args := &CArgs{A: 100, B: 200}
 	var reply int
 	err := xc.Call(context.Background(), "CalcService.Add", args, &reply)
@@ -0,0 +1,219 @@
+package xclient
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Balancer picks one server out of the candidates for a call.
+// Every Discovery creates its own Balancer for each SelectMode,
+// Pick is called with the Discovery locked.
+type Balancer interface {
+	Pick(servers []string, info *PickInfo) (string, error)
+}
+
+// PickInfo carries what a Balancer may need besides the server list.
+type PickInfo struct {
+	Key     string         // hash key of the call, used by ConsistentHashSelect
+	Weights map[string]int // weights published to the registry, missing means 1
+	Stats   Stats          // runtime load of the servers, may be nil
+}
+
+// Stats reports the runtime load of servers, XClient implements it.
+type Stats interface {
+	Pending(rpcAddr string) int           // number of calls waiting for a reply
+	Latency(rpcAddr string) time.Duration // EWMA of call latencies, 0 if unknown
+}
+
+// NewBalancerFunc creates the Balancer of a SelectMode.
+type NewBalancerFunc func() Balancer
+
+// NewBalancerFuncMap maps every SelectMode to its Balancer,
+// register a new SelectMode here to plug in your own Balancer.
+var NewBalancerFuncMap map[SelectMode]NewBalancerFunc
+
+func init() {
+	NewBalancerFuncMap = make(map[SelectMode]NewBalancerFunc)
+	NewBalancerFuncMap[RandomSelect] = NewRandomBalancer
+	NewBalancerFuncMap[RoundRobinSelect] = NewRoundRobinBalancer
+	NewBalancerFuncMap[WeightedRoundRobinSelect] = NewWeightedRoundRobinBalancer
+	NewBalancerFuncMap[LeastPendingSelect] = NewLeastPendingBalancer
+	NewBalancerFuncMap[P2CSelect] = NewP2CBalancer
+	NewBalancerFuncMap[ConsistentHashSelect] = NewConsistentHashBalancer
+}
+
+var errNoServers = errors.New("rpc discovery: no available servers")
+
+func weightOf(info *PickInfo, rpcAddr string) int {
+	if info == nil || info.Weights == nil {
+		return 1
+	}
+	if w, ok := info.Weights[rpcAddr]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+type randomBalancer struct {
+	r *rand.Rand // generate random number
+}
+
+func NewRandomBalancer() Balancer {
+	return &randomBalancer{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *randomBalancer) Pick(servers []string, _ *PickInfo) (string, error) {
+	if len(servers) == 0 {
+		return "", errNoServers
+	}
+	return servers[b.r.Intn(len(servers))], nil
+}
+
+type roundRobinBalancer struct {
+	index int // record the selected position for robin algorithm
+}
+
+func NewRoundRobinBalancer() Balancer {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return &roundRobinBalancer{index: r.Intn(math.MaxInt32 - 1)}
+}
+
+func (b *roundRobinBalancer) Pick(servers []string, _ *PickInfo) (string, error) {
+	n := len(servers)
+	if n == 0 {
+		return "", errNoServers
+	}
+	s := servers[b.index%n]
+	b.index = (b.index + 1) % n
+	return s, nil
+}
+
+// weightedRoundRobinBalancer is the smooth weighted round robin used by nginx,
+// a server with weight 5 among 5,1,1 is picked as a a b a c a a.
+type weightedRoundRobinBalancer struct {
+	current map[string]int // current weight of every server
+}
+
+func NewWeightedRoundRobinBalancer() Balancer {
+	return &weightedRoundRobinBalancer{current: make(map[string]int)}
+}
+
+func (b *weightedRoundRobinBalancer) Pick(servers []string, info *PickInfo) (string, error) {
+	if len(servers) == 0 {
+		return "", errNoServers
+	}
+	total, best := 0, ""
+	alive := make(map[string]bool, len(servers))
+	for _, s := range servers {
+		alive[s] = true
+		w := weightOf(info, s)
+		total += w
+		b.current[s] += w
+		if best == "" || b.current[s] > b.current[best] {
+			best = s
+		}
+	}
+	b.current[best] -= total
+	// forget servers that are gone
+	for s := range b.current {
+		if !alive[s] {
+			delete(b.current, s)
+		}
+	}
+	return best, nil
+}
+
+// leastPendingBalancer picks the server with the fewest outstanding calls,
+// ties are broken randomly.
+type leastPendingBalancer struct {
+	r *rand.Rand
+}
+
+func NewLeastPendingBalancer() Balancer {
+	return &leastPendingBalancer{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *leastPendingBalancer) Pick(servers []string, info *PickInfo) (string, error) {
+	n := len(servers)
+	if n == 0 {
+		return "", errNoServers
+	}
+	if info == nil || info.Stats == nil {
+		return servers[b.r.Intn(n)], nil
+	}
+	best, least, ties := "", 0, 0
+	for _, s := range servers {
+		pending := info.Stats.Pending(s)
+		switch {
+		case best == "" || pending < least:
+			best, least, ties = s, pending, 1
+		case pending == least:
+			// reservoir sampling keeps every tied server equally likely
+			ties++
+			if b.r.Intn(ties) == 0 {
+				best = s
+			}
+		}
+	}
+	return best, nil
+}
+
+// p2cBalancer picks two servers randomly and keeps the one with the lower
+// cost, the cost is the EWMA latency weighted by the outstanding calls.
+// Servers without latency samples are given the mean latency of the others,
+// so they get probed without being preferred to every known server.
+type p2cBalancer struct {
+	r *rand.Rand
+}
+
+func NewP2CBalancer() Balancer {
+	return &p2cBalancer{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *p2cBalancer) Pick(servers []string, info *PickInfo) (string, error) {
+	n := len(servers)
+	if n == 0 {
+		return "", errNoServers
+	}
+	i := b.r.Intn(n)
+	if n == 1 || info == nil || info.Stats == nil {
+		return servers[i], nil
+	}
+	j := b.r.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	mean := meanLatency(servers, info.Stats)
+	ci, cj := b.cost(servers[i], info.Stats, mean), b.cost(servers[j], info.Stats, mean)
+	// on a tie, probe the server without samples
+	if cj < ci || (cj == ci && info.Stats.Latency(servers[j]) == 0) {
+		i = j
+	}
+	return servers[i], nil
+}
+
+func (b *p2cBalancer) cost(rpcAddr string, stats Stats, mean time.Duration) float64 {
+	latency := stats.Latency(rpcAddr)
+	if latency == 0 {
+		latency = mean
+	}
+	return float64(latency) * float64(stats.Pending(rpcAddr)+1)
+}
+
+// meanLatency returns the mean latency of the servers with samples, 0 if none.
+func meanLatency(servers []string, stats Stats) time.Duration {
+	var sum time.Duration
+	n := 0
+	for _, s := range servers {
+		if l := stats.Latency(s); l > 0 {
+			sum += l
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / time.Duration(n)
+}
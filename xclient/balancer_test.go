@@ -0,0 +1,130 @@
+package xclient
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeStats serves fixed pending counts and latencies.
+type fakeStats struct {
+	pending map[string]int
+	latency map[string]time.Duration
+	calls   int // of Pending
+}
+
+func (s *fakeStats) Pending(rpcAddr string) int {
+	s.calls++
+	return s.pending[rpcAddr]
+}
+
+func (s *fakeStats) Latency(rpcAddr string) time.Duration { return s.latency[rpcAddr] }
+
+func TestWeightedRoundRobinBalancer(t *testing.T) {
+	b := NewWeightedRoundRobinBalancer()
+	servers := []string{"a", "b", "c"}
+	info := &PickInfo{Weights: map[string]int{"a": 5}}
+	var picks []string
+	for i := 0; i < 7; i++ {
+		s, err := b.Pick(servers, info)
+		_assert(err == nil, "unexpected error %v", err)
+		picks = append(picks, s)
+	}
+	_assert(strings.Join(picks, "") == "aabacaa", "expect a smooth sequence, got %v", picks)
+}
+
+func TestLeastPendingBalancer(t *testing.T) {
+	b := NewLeastPendingBalancer()
+	servers := []string{"a", "b", "c"}
+	info := &PickInfo{Stats: &fakeStats{pending: map[string]int{"a": 3, "b": 1, "c": 2}}}
+	for i := 0; i < 10; i++ {
+		s, _ := b.Pick(servers, info)
+		_assert(s == "b", "expect the least loaded server, got %s", s)
+	}
+}
+
+func TestP2CBalancer(t *testing.T) {
+	b := NewP2CBalancer()
+	servers := []string{"fast", "slow"}
+	info := &PickInfo{Stats: &fakeStats{latency: map[string]time.Duration{
+		"fast": time.Millisecond,
+		"slow": time.Second,
+	}}}
+	// with two servers both are always compared
+	for i := 0; i < 10; i++ {
+		s, _ := b.Pick(servers, info)
+		_assert(s == "fast", "expect the faster server, got %s", s)
+	}
+}
+
+func TestDiscovery_SelectMode(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"a", "b"})
+	_, err := d.Get(SelectMode(100))
+	_assert(err != nil, "expect an unsupported select mode")
+
+	NewBalancerFuncMap[SelectMode(100)] = func() Balancer { return constBalancer("b") }
+	defer delete(NewBalancerFuncMap, SelectMode(100))
+	s, err := d.Get(SelectMode(100))
+	_assert(err == nil && s == "b", "expect the plugged-in balancer to be used")
+}
+
+type constBalancer string
+
+func (b constBalancer) Pick([]string, *PickInfo) (string, error) { return string(b), nil }
+
+func TestConsistentHashBalancer(t *testing.T) {
+	b := NewConsistentHashBalancer()
+	servers := []string{"tcp@a", "tcp@b", "tcp@c"}
+	picked := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		s, _ := b.Pick(servers, &PickInfo{Key: key})
+		again, _ := b.Pick(servers, &PickInfo{Key: key})
+		_assert(s == again, "the same key should land on the same server")
+		picked[key] = s
+	}
+
+	t.Run("minimal reshuffle", func(t *testing.T) {
+		servers := append(servers, "tcp@d")
+		moved := 0
+		for key, old := range picked {
+			s, _ := b.Pick(servers, &PickInfo{Key: key})
+			if s != old {
+				_assert(s == "tcp@d", "keys should only move to the new server, %s moved to %s", key, s)
+				moved++
+			}
+		}
+		_assert(moved > 0 && moved < 500, "expect about a quarter of the keys to move, got %d", moved)
+	})
+	t.Run("bounded load", func(t *testing.T) {
+		s, _ := b.Pick(servers, &PickInfo{Key: "0"})
+		stats := &fakeStats{pending: map[string]int{s: 10}}
+		other, _ := b.Pick(servers, &PickInfo{Key: "0", Stats: stats})
+		_assert(other != s, "an overloaded server should be skipped")
+		_assert(stats.calls == len(servers), "expect the loads to be read once per server, got %d reads", stats.calls)
+	})
+	t.Run("hash collision", func(t *testing.T) {
+		// the first virtual nodes of both servers have the same hash
+		b := NewConsistentHashBalancer().(*consistentHashBalancer)
+		b.build([]string{"tcp@s9837", "tcp@s13930000"})
+		_assert(len(b.keys) == len(b.ring) && len(b.keys) == 2*defaultReplicas-1,
+			"expect the colliding virtual node to be skipped, got %d keys on %d nodes", len(b.keys), len(b.ring))
+	})
+}
+
+func TestP2CBalancer_Unknown(t *testing.T) {
+	b := NewP2CBalancer()
+	servers := []string{"new", "fast", "slow"}
+	info := &PickInfo{Stats: &fakeStats{latency: map[string]time.Duration{
+		"fast": time.Millisecond,
+		"slow": time.Second,
+	}}}
+	picks := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		s, _ := b.Pick(servers, info)
+		picks[s]++
+	}
+	// new costs the mean, so it only wins against slow
+	_assert(picks["new"] > 0 && picks["new"] < picks["fast"], "expect new to be probed but not preferred, got %v", picks)
+}
@@ -0,0 +1,290 @@
+package xclient
+
+import (
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // calls flow normally
+	BreakerOpen                         // calls are rejected until OpenTimeout passes
+	BreakerHalfOpen                     // trial calls decide whether to close or open again
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerConfig decides when a Breaker opens and closes.
+type BreakerConfig struct {
+	ConsecutiveFailures int           // open after this many failures in a row, 0 means no limit
+	ErrorRate           float64       // open when the error rate of a window reaches it, 0 means no limit
+	MinRequests         int           // a window needs this many calls before ErrorRate applies
+	Window              time.Duration // length of the window counting the error rate
+	OpenTimeout         time.Duration // how long to stay open before trying again
+	HalfOpenSuccesses   int           // successes in a row needed to close from half-open
+	HalfOpenProbes      int           // trial calls in flight at once when half-open, 0 means HalfOpenSuccesses
+}
+
+var DefaultBreakerConfig = &BreakerConfig{
+	ConsecutiveFailures: 5,
+	ErrorRate:           0.5,
+	MinRequests:         20,
+	Window:              time.Second * 10,
+	OpenTimeout:         time.Second * 5,
+	HalfOpenSuccesses:   1,
+}
+
+// Breaker is the circuit breaker of one server.
+type Breaker struct {
+	cfg         *BreakerConfig
+	mu          sync.Mutex // protect following
+	state       BreakerState
+	consecutive int // failures in a row when closed, successes in a row when half-open
+	probes      int // trial calls in flight when half-open
+	requests    int // calls of the current window
+	errors      int // failed calls of the current window
+	windowStart time.Time
+	openedAt    time.Time
+}
+
+func NewBreaker(cfg *BreakerConfig) *Breaker {
+	return &Breaker{cfg: cfg, windowStart: time.Now()}
+}
+
+// State returns the state of the breaker, an open breaker whose
+// OpenTimeout has passed turns half-open.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.currentState()
+}
+
+func (b *Breaker) currentState() BreakerState {
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cfg.OpenTimeout {
+		b.state = BreakerHalfOpen
+		b.consecutive = 0
+		b.probes = 0
+	}
+	return b.state
+}
+
+func (b *Breaker) maxProbes() int {
+	if b.cfg.HalfOpenProbes > 0 {
+		return b.cfg.HalfOpenProbes
+	}
+	if b.cfg.HalfOpenSuccesses > 0 {
+		return b.cfg.HalfOpenSuccesses
+	}
+	return 1
+}
+
+// Allow reports whether calls may be sent to the server: always when
+// closed, never when open, and when half-open while there are fewer
+// trial calls in flight than allowed.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.currentState() {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		return b.probes < b.maxProbes()
+	default:
+		return false
+	}
+}
+
+// Begin is like Allow, and when half-open counts the call as a trial call
+// in flight until its Success, Fail or Cancel is recorded.
+func (b *Breaker) Begin() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.currentState() {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		if b.probes >= b.maxProbes() {
+			return false
+		}
+		b.probes++
+		return true
+	default:
+		return false
+	}
+}
+
+// Cancel records a call which says nothing about the server, such as
+// one cancelled by the caller.
+func (b *Breaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.currentState() == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// Success records a successful call, when half-open only trial calls count.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.currentState() {
+	case BreakerClosed:
+		b.count(false)
+		b.consecutive = 0
+	case BreakerHalfOpen:
+		if b.probes == 0 {
+			// sent before the breaker opened
+			return
+		}
+		b.probes--
+		b.consecutive++
+		if b.consecutive >= b.cfg.HalfOpenSuccesses {
+			b.reset(BreakerClosed)
+		}
+	}
+}
+
+// Fail records a failed call, when half-open the first failed trial call
+// opens the breaker again.
+func (b *Breaker) Fail() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.currentState() {
+	case BreakerClosed:
+		b.count(true)
+		b.consecutive++
+		if b.cfg.ConsecutiveFailures > 0 && b.consecutive >= b.cfg.ConsecutiveFailures ||
+			b.cfg.ErrorRate > 0 && b.requests >= b.cfg.MinRequests &&
+				float64(b.errors)/float64(b.requests) >= b.cfg.ErrorRate {
+			b.reset(BreakerOpen)
+		}
+	case BreakerHalfOpen:
+		if b.probes == 0 {
+			// sent before the breaker opened
+			return
+		}
+		b.probes--
+		b.reset(BreakerOpen)
+	}
+}
+
+// count adds a call to the current window, starting a new window when it's over.
+func (b *Breaker) count(failed bool) {
+	if time.Since(b.windowStart) >= b.cfg.Window {
+		b.requests, b.errors = 0, 0
+		b.windowStart = time.Now()
+	}
+	b.requests++
+	if failed {
+		b.errors++
+	}
+}
+
+func (b *Breaker) reset(state BreakerState) {
+	b.state = state
+	b.consecutive = 0
+	b.probes = 0
+	b.requests, b.errors = 0, 0
+	b.windowStart = time.Now()
+	if state == BreakerOpen {
+		b.openedAt = time.Now()
+	}
+}
+
+// BreakerGroup keeps a Breaker for every server, it is the Filter
+// XClient adds to its Discovery.
+type BreakerGroup struct {
+	mu       sync.Mutex // protect following
+	cfg      *BreakerConfig
+	breakers map[string]*Breaker
+}
+
+var _ Filter = (*BreakerGroup)(nil)
+
+// NewBreakerGroup creates a BreakerGroup, a nil cfg disables the breakers.
+func NewBreakerGroup(cfg *BreakerConfig) *BreakerGroup {
+	return &BreakerGroup{cfg: cfg, breakers: make(map[string]*Breaker)}
+}
+
+// SetConfig replaces the config, resetting all breakers. A nil cfg disables them.
+func (g *BreakerGroup) SetConfig(cfg *BreakerConfig) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cfg = cfg
+	g.breakers = make(map[string]*Breaker)
+}
+
+func (g *BreakerGroup) get(rpcAddr string) *Breaker {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cfg == nil {
+		return nil
+	}
+	b := g.breakers[rpcAddr]
+	if b == nil {
+		b = NewBreaker(g.cfg)
+		g.breakers[rpcAddr] = b
+	}
+	return b
+}
+
+// Allow reports whether the breaker of rpcAddr lets calls through.
+func (g *BreakerGroup) Allow(rpcAddr string) bool {
+	b := g.get(rpcAddr)
+	return b == nil || b.Allow()
+}
+
+// Begin reports whether a call may be sent to rpcAddr, and counts it as
+// a trial call when its breaker is half-open. Report must follow.
+func (g *BreakerGroup) Begin(rpcAddr string) bool {
+	b := g.get(rpcAddr)
+	return b == nil || b.Begin()
+}
+
+// Cancel records a call to rpcAddr which says nothing about the server.
+func (g *BreakerGroup) Cancel(rpcAddr string) {
+	if b := g.get(rpcAddr); b != nil {
+		b.Cancel()
+	}
+}
+
+// Report records the result of a call to rpcAddr.
+func (g *BreakerGroup) Report(rpcAddr string, failed bool) {
+	b := g.get(rpcAddr)
+	if b == nil {
+		return
+	}
+	if failed {
+		b.Fail()
+	} else {
+		b.Success()
+	}
+}
+
+// States returns the state of every breaker, for debugging.
+func (g *BreakerGroup) States() map[string]BreakerState {
+	g.mu.Lock()
+	breakers := make(map[string]*Breaker, len(g.breakers))
+	for addr, b := range g.breakers {
+		breakers[addr] = b
+	}
+	g.mu.Unlock()
+
+	states := make(map[string]BreakerState, len(breakers))
+	for addr, b := range breakers {
+		states[addr] = b.State()
+	}
+	return states
+}
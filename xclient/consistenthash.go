@@ -0,0 +1,116 @@
+package xclient
+
+import (
+	"context"
+	"hash/crc32"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultReplicas   = 100  // virtual nodes of every server on the ring
+	defaultLoadFactor = 1.25 // a server may take at most 1.25 times the average load
+)
+
+type hashKeyCtxKey struct{}
+
+// WithHashKey returns a context carrying the key used by ConsistentHashSelect,
+// calls with the same key land on the same server.
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyCtxKey{}, key)
+}
+
+func hashKeyFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	key, _ := ctx.Value(hashKeyCtxKey{}).(string)
+	return key
+}
+
+// HashKeyFunc derives the key used by ConsistentHashSelect from a call.
+type HashKeyFunc func(serviceMethod string, args interface{}) string
+
+// consistentHashBalancer maps keys onto a hash ring of virtual nodes.
+// Changing the server list only moves the keys of the servers added or removed.
+// When Stats is available, loads are bounded: a server already above
+// loadFactor times the average load is skipped for the next one on the ring.
+type consistentHashBalancer struct {
+	replicas   int
+	loadFactor float64
+	members    string   // servers the ring was built from
+	keys       []uint32 // sorted
+	ring       map[uint32]string
+	r          *rand.Rand
+}
+
+func NewConsistentHashBalancer() Balancer {
+	return &consistentHashBalancer{
+		replicas:   defaultReplicas,
+		loadFactor: defaultLoadFactor,
+		r:          rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (b *consistentHashBalancer) build(servers []string) {
+	sorted := make([]string, len(servers))
+	copy(sorted, servers)
+	sort.Strings(sorted)
+	members := strings.Join(sorted, ",")
+	if members == b.members && b.ring != nil {
+		return
+	}
+	b.members = members
+	b.keys = make([]uint32, 0, len(servers)*b.replicas)
+	b.ring = make(map[uint32]string, len(servers)*b.replicas)
+	for _, s := range sorted {
+		for i := 0; i < b.replicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + s))
+			if _, ok := b.ring[hash]; ok {
+				// a collision, the virtual node goes to the first server in order
+				continue
+			}
+			b.keys = append(b.keys, hash)
+			b.ring[hash] = s
+		}
+	}
+	sort.Slice(b.keys, func(i, j int) bool { return b.keys[i] < b.keys[j] })
+}
+
+func (b *consistentHashBalancer) Pick(servers []string, info *PickInfo) (string, error) {
+	n := len(servers)
+	if n == 0 {
+		return "", errNoServers
+	}
+	if info == nil || info.Key == "" {
+		// nothing to be sticky to
+		return servers[b.r.Intn(n)], nil
+	}
+	b.build(servers)
+
+	hash := crc32.ChecksumIEEE([]byte(info.Key))
+	idx := sort.Search(len(b.keys), func(i int) bool { return b.keys[i] >= hash })
+	if info.Stats == nil {
+		return b.ring[b.keys[idx%len(b.keys)]], nil
+	}
+
+	// one snapshot of the loads, Pending may take a lock of its own
+	pending := make(map[string]int, n)
+	total := 0
+	for _, s := range servers {
+		pending[s] = info.Stats.Pending(s)
+		total += pending[s]
+	}
+	limit := int(math.Ceil(float64(total+1) * b.loadFactor / float64(n)))
+	for i := 0; i < len(b.keys); i++ {
+		s := b.ring[b.keys[(idx+i)%len(b.keys)]]
+		if pending[s]+1 <= limit {
+			return s, nil
+		}
+	}
+	return b.ring[b.keys[idx%len(b.keys)]], nil
+}
@@ -2,17 +2,18 @@ package xclient
 
 import (
 	"errors"
-	"math"
-	"math/rand"
 	"sync"
-	"time"
 )
 
 type SelectMode int
 
 const (
-	RandomSelect     SelectMode = iota // select randomly
-	RoundRobinSelect                   // select using Robbin algorithm
+	RandomSelect             SelectMode = iota // select randomly
+	RoundRobinSelect                           // select using Robbin algorithm
+	WeightedRoundRobinSelect                   // smooth weighted round robin on registry weights
+	LeastPendingSelect                         // select the server with the fewest outstanding calls
+	P2CSelect                                  // power of two choices on EWMA latency
+	ConsistentHashSelect                       // select by the hash key of the call
 )
 
 type Discovery interface {
@@ -22,23 +23,29 @@ type Discovery interface {
 	GetAll() ([]string, error)
 }
 
+// Filter decides whether Discovery.Get may hand out a server,
+// e.g. to skip servers whose circuit breaker is open.
+type Filter interface {
+	Allow(rpcAddr string) bool
+}
+
 type MultiServersDiscovery struct {
-	r       *rand.Rand   // generate random number
-	mu      sync.RWMutex // protect following
-	servers []string
-	index   int // record the selected position for robin algorithm
+	mu        sync.RWMutex // protect following
+	servers   []string
+	weights   map[string]int
+	balancers map[SelectMode]Balancer // created on first use of every mode
+	stats     Stats
+	filters   []Filter
 }
 
 var _ Discovery = (*MultiServersDiscovery)(nil)
 
 // NewMultiServerDiscovery creates a MultiServersDiscovery instance
 func NewMultiServerDiscovery(servers []string) *MultiServersDiscovery {
-	d := &MultiServersDiscovery{
-		servers: servers,
-		r:       rand.New(rand.NewSource(time.Now().Unix())),
+	return &MultiServersDiscovery{
+		servers:   servers,
+		balancers: make(map[SelectMode]Balancer),
 	}
-	d.index = d.r.Intn(math.MaxInt32 - 1)
-	return d
 }
 
 func (d *MultiServersDiscovery) Refresh() error {
@@ -52,23 +59,92 @@ func (d *MultiServersDiscovery) Update(servers []string) error {
 	return nil
 }
 
+// UpdateWeights sets the weights used by WeightedRoundRobinSelect,
+// servers without a weight count as 1.
+func (d *MultiServersDiscovery) UpdateWeights(weights map[string]int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.weights = weights
+}
+
+// SetStats sets the source of runtime load used by the load-aware balancers.
+func (d *MultiServersDiscovery) SetStats(stats Stats) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stats = stats
+}
+
+// AddFilter adds a Filter consulted by Get, servers rejected by any filter are skipped.
+func (d *MultiServersDiscovery) AddFilter(f Filter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.filters = append(d.filters, f)
+}
+
+// RemoveFilter removes a Filter added by AddFilter, f must be comparable.
+func (d *MultiServersDiscovery) RemoveFilter(f Filter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, g := range d.filters {
+		if g == f {
+			// copy, Get may be ranging over the old slice
+			d.filters = append(append([]Filter(nil), d.filters[:i]...), d.filters[i+1:]...)
+			return
+		}
+	}
+}
+
+// available returns the servers allowed by all filters, except the ones of except.
+func (d *MultiServersDiscovery) available(except []string) []string {
+	if len(d.filters) == 0 && len(except) == 0 {
+		return d.servers
+	}
+	servers := make([]string, 0, len(d.servers))
+outer:
+	for _, s := range d.servers {
+		for _, e := range except {
+			if s == e {
+				continue outer
+			}
+		}
+		for _, f := range d.filters {
+			if !f.Allow(s) {
+				continue outer
+			}
+		}
+		servers = append(servers, s)
+	}
+	return servers
+}
+
 func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
+	return d.GetByKey(mode, "")
+}
+
+// GetByKey is like Get, and passes the hash key of the call to the Balancer.
+func (d *MultiServersDiscovery) GetByKey(mode SelectMode, key string) (string, error) {
+	return d.GetByKeyExcept(mode, key, nil)
+}
+
+// GetByKeyExcept is like GetByKey, but never hands out the servers of except,
+// e.g. the ones a call has already been sent to.
+func (d *MultiServersDiscovery) GetByKeyExcept(mode SelectMode, key string, except []string) (string, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	n := len(d.servers)
-	if n == 0 {
-		return "", errors.New("rpc discovery: no available servers")
+	servers := d.available(except)
+	if len(servers) == 0 {
+		return "", errNoServers
 	}
-	switch mode {
-	case RandomSelect:
-		return d.servers[d.r.Intn(n)], nil
-	case RoundRobinSelect:
-		s := d.servers[d.index%n]
-		d.index = (d.index + 1) % n
-		return s, nil
-	default:
-		return "", errors.New("rpc discovery: not supported select mode")
+	b := d.balancers[mode]
+	if b == nil {
+		newBalancer := NewBalancerFuncMap[mode]
+		if newBalancer == nil {
+			return "", errors.New("rpc discovery: not supported select mode")
+		}
+		b = newBalancer()
+		d.balancers[mode] = b
 	}
+	return b.Pick(servers, &PickInfo{Key: key, Weights: d.weights, Stats: d.stats})
 }
 
 func (d *MultiServersDiscovery) GetAll() ([]string, error) {
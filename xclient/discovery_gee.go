@@ -3,6 +3,7 @@ package xclient
 import (
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -49,6 +50,7 @@ func (d *GeeRegistryDiscovery) Refresh() error {
 		log.Println("rpc registry refresh error", err)
 		return err
 	}
+	_ = resp.Body.Close()
 	servers := strings.Split(resp.Header.Get("X-Geerpc-Servers"), ",")
 	d.servers = make([]string, 0, len(servers))
 	for _, server := range servers {
@@ -56,10 +58,26 @@ func (d *GeeRegistryDiscovery) Refresh() error {
 			d.servers = append(d.servers, server)
 		}
 	}
+	d.weights = parseWeights(resp.Header.Get("X-Geerpc-Weights"))
 	d.lastUpdate = time.Now()
 	return nil
 }
 
+// parseWeights parses the X-Geerpc-Weights header, formatted as addr=weight,addr=weight
+func parseWeights(header string) map[string]int {
+	weights := make(map[string]int)
+	for _, item := range strings.Split(header, ",") {
+		eq := strings.LastIndex(item, "=")
+		if eq < 0 {
+			continue
+		}
+		if w, err := strconv.Atoi(item[eq+1:]); err == nil {
+			weights[strings.TrimSpace(item[:eq])] = w
+		}
+	}
+	return weights
+}
+
 func (d *GeeRegistryDiscovery) Get(mode SelectMode) (string, error) {
 	if err := d.Refresh(); err != nil {
 		return "", err
@@ -67,6 +85,20 @@ func (d *GeeRegistryDiscovery) Get(mode SelectMode) (string, error) {
 	return d.MultiServersDiscovery.Get(mode)
 }
 
+func (d *GeeRegistryDiscovery) GetByKey(mode SelectMode, key string) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServersDiscovery.GetByKey(mode, key)
+}
+
+func (d *GeeRegistryDiscovery) GetByKeyExcept(mode SelectMode, key string, except []string) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServersDiscovery.GetByKeyExcept(mode, key, except)
+}
+
 func (d *GeeRegistryDiscovery) GetAll() ([]string, error) {
 	if err := d.Refresh(); err != nil {
 		return nil, err
@@ -0,0 +1,140 @@
+package xclient
+
+import (
+	"context"
+	"geerpc/geerpc"
+	"geerpc/registry"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// RPCRegistryDiscovery keeps the servers of a registry served as a GeeRPC
+// service up to date: it calls Registry.Watch over one connection, and updates
+// its servers as soon as they change. When watching fails, it falls back to
+// calling Registry.List every pollInterval until the registry answers again.
+type RPCRegistryDiscovery struct {
+	*MultiServersDiscovery
+	rpcAddr      string // of the registry, formatted as protocol@addr
+	filter       registry.Filter
+	pollInterval time.Duration
+	revision     uint64 // of the servers, protected by mu
+	clientMu     sync.Mutex
+	client       *geerpc.Client // dialed on first use and after an error
+	cancel       context.CancelFunc
+	done         chan struct{} // closed when the watch loop has returned
+}
+
+var _ Discovery = (*RPCRegistryDiscovery)(nil)
+var _ io.Closer = (*RPCRegistryDiscovery)(nil)
+
+// NewRPCRegistryDiscovery fetches the servers matching filter from the
+// registry at rpcAddr, and starts watching it until Close is called.
+func NewRPCRegistryDiscovery(rpcAddr string, filter registry.Filter, pollInterval time.Duration) *RPCRegistryDiscovery {
+	if pollInterval == 0 {
+		pollInterval = defaultPollInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &RPCRegistryDiscovery{
+		MultiServersDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		rpcAddr:               rpcAddr,
+		filter:                filter,
+		pollInterval:          pollInterval,
+		cancel:                cancel,
+		done:                  make(chan struct{}),
+	}
+	if err := d.Refresh(); err != nil {
+		log.Println("rpc registry refresh error", err)
+	}
+	go d.watch(ctx)
+	return d
+}
+
+// Refresh fetches the servers from the registry right away.
+func (d *RPCRegistryDiscovery) Refresh() error {
+	return d.fetch(context.Background(), false)
+}
+
+// Close stops watching the registry and closes the connection to it.
+func (d *RPCRegistryDiscovery) Close() error {
+	d.cancel()
+	<-d.done
+	d.clientMu.Lock()
+	defer d.clientMu.Unlock()
+	if d.client != nil {
+		_ = d.client.Close()
+		d.client = nil
+	}
+	return nil
+}
+
+func (d *RPCRegistryDiscovery) watch(ctx context.Context) {
+	defer close(d.done)
+	for ctx.Err() == nil {
+		err := d.fetch(ctx, true)
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		log.Println("rpc registry: watch error, fall back to polling:", err)
+		for polled := false; !polled; {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(d.pollInterval):
+			}
+			polled = d.fetch(ctx, false) == nil
+		}
+	}
+}
+
+func (d *RPCRegistryDiscovery) getClient() (*geerpc.Client, error) {
+	d.clientMu.Lock()
+	defer d.clientMu.Unlock()
+	if d.client != nil && d.client.IsAvailable() {
+		return d.client, nil
+	}
+	if d.client != nil {
+		_ = d.client.Close()
+	}
+	client, err := geerpc.XDial(d.rpcAddr)
+	if err != nil {
+		d.client = nil
+		return nil, err
+	}
+	d.client = client
+	return client, nil
+}
+
+// fetch calls Registry.List, or Registry.Watch when watch is set, and updates d.
+func (d *RPCRegistryDiscovery) fetch(ctx context.Context, watch bool) error {
+	client, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	var list registry.InstanceList
+	if watch {
+		d.mu.RLock()
+		args := registry.WatchArgs{Filter: d.filter, Revision: d.revision, Timeout: watchTimeout}
+		d.mu.RUnlock()
+		err = client.Call(ctx, registry.ServiceName+".Watch", args, &list)
+	} else {
+		err = client.Call(ctx, registry.ServiceName+".List", d.filter, &list)
+	}
+	if err != nil {
+		return err
+	}
+
+	servers := make([]string, 0, len(list.Instances))
+	weights := make(map[string]int)
+	for _, s := range list.Instances {
+		servers = append(servers, s.Addr)
+		if s.Weight > 0 {
+			weights[s.Addr] = s.Weight
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.servers, d.weights, d.revision = servers, weights, list.Revision
+	return nil
+}
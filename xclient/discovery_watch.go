@@ -0,0 +1,196 @@
+package xclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geerpc/registry"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// WatchRegistryDiscovery keeps the servers of a GeeRegistry up to date: it
+// long-polls the watch endpoint of the JSON API of the registry, and updates
+// its servers as soon as they change. When watching fails, it falls back to
+// polling every pollInterval until the registry answers again.
+//
+// Given the nodes of a registry cluster, it uses one of them at a time and
+// fails over to the next one when it stops answering.
+//
+// It only knows the servers selected by its filter, by default the servers
+// of the default namespace.
+type WatchRegistryDiscovery struct {
+	*MultiServersDiscovery
+	registries   []string
+	filter       registry.Filter
+	pollInterval time.Duration
+	client       *http.Client
+	current      int    // index of the registry in use, protected by mu
+	revision     uint64 // of the servers on the registry in use, protected by mu
+	cancel       context.CancelFunc
+	done         chan struct{} // closed when the watch loop has returned
+}
+
+const (
+	instancesPath       = "/v1/instances"
+	defaultPollInterval = time.Second * 10
+	watchTimeout        = time.Second * 30 // how long the registry holds a watch without change
+)
+
+var errNoRegistry = errors.New("rpc registry: no registry to watch")
+
+var _ Discovery = (*WatchRegistryDiscovery)(nil)
+var _ io.Closer = (*WatchRegistryDiscovery)(nil)
+
+// NewWatchRegistryDiscovery fetches the servers from registry, the URL the
+// registry is served at, and starts watching it until Close is called.
+func NewWatchRegistryDiscovery(registry string, pollInterval time.Duration) *WatchRegistryDiscovery {
+	return NewClusterDiscovery([]string{registry}, pollInterval)
+}
+
+// NewClusterDiscovery is like NewWatchRegistryDiscovery for the nodes of a
+// registry cluster, registries are the URLs they are served at.
+func NewClusterDiscovery(registries []string, pollInterval time.Duration) *WatchRegistryDiscovery {
+	return NewFilteredDiscovery(registries, registry.Filter{}, pollInterval)
+}
+
+// NewNamespaceDiscovery is like NewClusterDiscovery, scoped to the servers
+// of service in namespace.
+func NewNamespaceDiscovery(registries []string, namespace, service string, pollInterval time.Duration) *WatchRegistryDiscovery {
+	return NewFilteredDiscovery(registries, registry.Filter{Namespace: namespace, Services: []string{service}}, pollInterval)
+}
+
+// NewFilteredDiscovery is like NewClusterDiscovery, scoped to the servers
+// selected by filter. Without registries, the error is logged and the
+// discovery has no servers.
+func NewFilteredDiscovery(registries []string, filter registry.Filter, pollInterval time.Duration) *WatchRegistryDiscovery {
+	if pollInterval == 0 {
+		pollInterval = defaultPollInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &WatchRegistryDiscovery{
+		MultiServersDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		registries:            registries,
+		filter:                filter,
+		pollInterval:          pollInterval,
+		client:                &http.Client{Timeout: watchTimeout + pollInterval},
+		cancel:                cancel,
+		done:                  make(chan struct{}),
+	}
+	if err := d.Refresh(); err != nil {
+		log.Println("rpc registry refresh error", err)
+	}
+	if len(registries) == 0 {
+		close(d.done)
+		return d
+	}
+	go d.watch(ctx)
+	return d
+}
+
+// Refresh fetches the servers from the registry right away.
+func (d *WatchRegistryDiscovery) Refresh() error {
+	return d.poll(context.Background())
+}
+
+// Close stops watching the registry.
+func (d *WatchRegistryDiscovery) Close() error {
+	d.cancel()
+	<-d.done
+	return nil
+}
+
+func (d *WatchRegistryDiscovery) watch(ctx context.Context) {
+	defer close(d.done)
+	for ctx.Err() == nil {
+		d.mu.RLock()
+		node := d.registries[d.current]
+		d.mu.RUnlock()
+		err := d.fetch(ctx, node, true)
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		log.Println("rpc registry: watch error, fall back to polling:", err)
+		for d.poll(ctx) != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(d.pollInterval):
+			}
+		}
+	}
+}
+
+// poll fetches the servers from the registry in use, or from the next ones
+// until one answers, which is used from now on.
+func (d *WatchRegistryDiscovery) poll(ctx context.Context) error {
+	d.mu.RLock()
+	current := d.current
+	d.mu.RUnlock()
+	err := errNoRegistry
+	for i := range d.registries {
+		node := d.registries[(current+i)%len(d.registries)]
+		if err = d.fetch(ctx, node, false); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// fetch gets the servers from node, the URL of a registry, waiting for them
+// to change when watch is set, and updates d.
+func (d *WatchRegistryDiscovery) fetch(ctx context.Context, node string, watch bool) error {
+	query := d.filter.Query()
+	if watch {
+		d.mu.RLock()
+		query.Set("watch", strconv.FormatUint(d.revision, 10))
+		d.mu.RUnlock()
+		query.Set("timeout", watchTimeout.String())
+	}
+	url := node + instancesPath
+	if len(query) > 0 {
+		url += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rpc registry: %s", resp.Status)
+	}
+	var list registry.InstanceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return err
+	}
+
+	servers := make([]string, 0, len(list.Instances))
+	weights := make(map[string]int)
+	for _, s := range list.Instances {
+		servers = append(servers, s.Addr)
+		if s.Weight > 0 {
+			weights[s.Addr] = s.Weight
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.servers, d.weights, d.revision = servers, weights, list.Revision
+	for i, r := range d.registries {
+		if r == node && i != d.current {
+			log.Println("rpc registry: switch to", node)
+			d.current = i
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package xclient
+
+import (
+	"context"
+	"fmt"
+	. "geerpc/geerpc"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// HealthCheckConfig decides how often servers are checked and how long
+// an unhealthy server is ejected.
+type HealthCheckConfig struct {
+	Interval         time.Duration // time between two rounds of checks
+	Timeout          time.Duration // timeout of a single check
+	FailureThreshold int           // failed checks in a row before a server is ejected
+	CoolDown         time.Duration // how long an ejected server stays out
+}
+
+var DefaultHealthCheckConfig = &HealthCheckConfig{
+	Interval:         time.Second * 5,
+	Timeout:          time.Second,
+	FailureThreshold: 2,
+	CoolDown:         time.Second * 30,
+}
+
+// HealthChecker periodically calls "Health.Check" on every server of a Discovery
+// and ejects the servers failing it for a cool-down period. It is a Filter,
+// so a Discovery it's added to never hands out an ejected server, unless
+// every server is ejected: calls then go to all of them rather than failing
+// with no available servers, as the checks may be the ones failing.
+type HealthChecker struct {
+	d        Discovery
+	opt      *Option
+	cfg      *HealthCheckConfig
+	mu       sync.Mutex // protect following
+	clients  map[string]*Client
+	failures map[string]int       // failed checks in a row
+	ejected  map[string]time.Time // ejected until
+	allOut   bool                 // every server was ejected at the end of the last round
+	done     chan struct{}
+}
+
+var _ Filter = (*HealthChecker)(nil)
+var _ io.Closer = (*HealthChecker)(nil)
+
+// NewHealthChecker starts checking the servers of d, and adds itself
+// as a Filter of d when d supports filters, until Close is called.
+// A nil cfg uses DefaultHealthCheckConfig.
+func NewHealthChecker(d Discovery, opt *Option, cfg *HealthCheckConfig) *HealthChecker {
+	if cfg == nil {
+		cfg = DefaultHealthCheckConfig
+	}
+	hc := &HealthChecker{
+		d:        d,
+		opt:      opt,
+		cfg:      cfg,
+		clients:  make(map[string]*Client),
+		failures: make(map[string]int),
+		ejected:  make(map[string]time.Time),
+		done:     make(chan struct{}),
+	}
+	if f, ok := d.(interface{ AddFilter(Filter) }); ok {
+		f.AddFilter(hc)
+	}
+	go hc.run()
+	return hc
+}
+
+func (hc *HealthChecker) run() {
+	t := time.NewTicker(hc.cfg.Interval)
+	defer t.Stop()
+	for {
+		hc.checkAll()
+		select {
+		case <-hc.done:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (hc *HealthChecker) checkAll() {
+	servers, err := hc.d.GetAll()
+	if err != nil {
+		log.Println("rpc health: get servers error:", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, rpcAddr := range servers {
+		wg.Add(1)
+		go func(rpcAddr string) {
+			defer wg.Done()
+			hc.report(rpcAddr, hc.check(rpcAddr))
+		}(rpcAddr)
+	}
+	wg.Wait()
+	hc.prune(servers)
+}
+
+// prune forgets the servers which left the Discovery, closing their
+// connections, and records whether all the others are ejected.
+func (hc *HealthChecker) prune(servers []string) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	known := make(map[string]bool, len(servers))
+	allOut := len(servers) > 0
+	for _, rpcAddr := range servers {
+		known[rpcAddr] = true
+		allOut = allOut && hc.isEjected(rpcAddr)
+	}
+	hc.allOut = allOut
+	for rpcAddr, client := range hc.clients {
+		if !known[rpcAddr] {
+			_ = client.Close()
+			delete(hc.clients, rpcAddr)
+		}
+	}
+	for rpcAddr := range hc.failures {
+		if !known[rpcAddr] {
+			delete(hc.failures, rpcAddr)
+		}
+	}
+	for rpcAddr := range hc.ejected {
+		if !known[rpcAddr] {
+			delete(hc.ejected, rpcAddr)
+		}
+	}
+}
+
+// check calls Health.Check on rpcAddr, reusing the connection of the last check.
+func (hc *HealthChecker) check(rpcAddr string) error {
+	hc.mu.Lock()
+	client := hc.clients[rpcAddr]
+	hc.mu.Unlock()
+	if client == nil || !client.IsAvailable() {
+		var err error
+		if client, err = XDial(rpcAddr, hc.opt); err != nil {
+			return err
+		}
+		hc.mu.Lock()
+		if hc.closed() {
+			// Close has already closed the clients
+			hc.mu.Unlock()
+			_ = client.Close()
+			return fmt.Errorf("rpc health: checker closed")
+		}
+		if old := hc.clients[rpcAddr]; old != nil {
+			_ = old.Close()
+		}
+		hc.clients[rpcAddr] = client
+		hc.mu.Unlock()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hc.cfg.Timeout)
+	defer cancel()
+	var reply HealthCheckReply
+	if err := client.Call(ctx, "Health.Check", HealthCheckArgs{}, &reply); err != nil {
+		return err
+	}
+	if reply.Status != HealthServing {
+		return fmt.Errorf("rpc health: %s is %s", rpcAddr, reply.Status)
+	}
+	return nil
+}
+
+func (hc *HealthChecker) report(rpcAddr string, err error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if err == nil {
+		hc.failures[rpcAddr] = 0
+		return
+	}
+	hc.failures[rpcAddr]++
+	if hc.failures[rpcAddr] >= hc.cfg.FailureThreshold && !hc.isEjected(rpcAddr) {
+		log.Printf("rpc health: eject %s for %s: %v", rpcAddr, hc.cfg.CoolDown, err)
+		hc.ejected[rpcAddr] = time.Now().Add(hc.cfg.CoolDown)
+	}
+}
+
+func (hc *HealthChecker) isEjected(rpcAddr string) bool {
+	until, ok := hc.ejected[rpcAddr]
+	if ok && !time.Now().Before(until) {
+		delete(hc.ejected, rpcAddr)
+		return false
+	}
+	return ok
+}
+
+// Allow reports whether rpcAddr is not ejected, or every server is.
+func (hc *HealthChecker) Allow(rpcAddr string) bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.allOut || !hc.isEjected(rpcAddr)
+}
+
+// Ejected returns the ejected servers and when they come back.
+func (hc *HealthChecker) Ejected() map[string]time.Time {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	ejected := make(map[string]time.Time, len(hc.ejected))
+	for rpcAddr := range hc.ejected {
+		if hc.isEjected(rpcAddr) {
+			ejected[rpcAddr] = hc.ejected[rpcAddr]
+		}
+	}
+	return ejected
+}
+
+// closed reports whether Close was called, hc.mu must be held.
+func (hc *HealthChecker) closed() bool {
+	select {
+	case <-hc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops checking, removes hc from the filters of the Discovery,
+// and closes the connections used by the checks.
+func (hc *HealthChecker) Close() error {
+	if f, ok := hc.d.(interface{ RemoveFilter(Filter) }); ok {
+		f.RemoveFilter(hc)
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.closed() {
+		return nil
+	}
+	close(hc.done)
+	for rpcAddr, client := range hc.clients {
+		_ = client.Close()
+		delete(hc.clients, rpcAddr)
+	}
+	return nil
+}
@@ -2,27 +2,220 @@ package xclient
 
 import (
 	"context"
+	"errors"
 	. "geerpc/geerpc"
 	"io"
+	"log"
 	"reflect"
 	"sync"
+	"time"
+)
+
+// FailMode decides what XClient.Call does when a call fails.
+type FailMode int
+
+const (
+	Failfast   FailMode = iota // return the error immediately
+	Failover                   // retry on another server chosen by SelectMode
+	Failtry                    // retry on the same server
+	Failbackup                 // send a backup request of an idempotent method when the first one is slow, take the first success
+)
+
+const (
+	defaultRetries       = 3
+	defaultBackupLatency = time.Millisecond * 10
+	latencyDecay         = 0.3 // weight of the newest sample in the latency EWMA
+	// failurePenalty is added to the latency of a failed call, so that a server
+	// failing fast doesn't look like the fastest one
+	failurePenalty = time.Second
+	// probeTimeout bounds asking a server whether a method is idempotent
+	probeTimeout = time.Second
 )
 
 type XClient struct {
-	d       Discovery
-	mode    SelectMode
-	opt     *Option
-	mu      sync.Mutex // protect following
-	clients map[string]*Client
+	d             Discovery
+	mode          SelectMode
+	failMode      FailMode
+	retries       int           // used by Failover and Failtry
+	backupLatency time.Duration // used by Failbackup
+	hashKey       HashKeyFunc   // used by ConsistentHashSelect when the context has no key
+	breakers      *BreakerGroup
+	opt           *Option
+	mu            sync.Mutex // protect following
+	clients       map[string]*Client
+	latMu         sync.Mutex // protect following
+	latency       map[string]time.Duration
+	idemMu        sync.Mutex      // protect following
+	idempotent    map[string]bool // serviceMethod -> MethodOptions.Idempotent
+	probing       map[string]bool // serviceMethods being asked in the background
 }
 
+// notSentError is the error of a call which never reached the server,
+// such a call is safe to send again whatever the method.
+type notSentError struct{ error }
+
+var errBreakerOpen = errors.New("rpc client: circuit breaker is open")
+
+func (e notSentError) Unwrap() error { return e.error }
+
 var _ io.Closer = (*XClient)(nil)
+var _ Caller = (*XClient)(nil)
+var _ AsyncCaller = (*XClient)(nil)
+var _ Stats = (*XClient)(nil)
+
+func NewXClient(d Discovery, mode SelectMode, failMode FailMode, opt *Option) *XClient {
+	xc := &XClient{
+		d:             d,
+		mode:          mode,
+		failMode:      failMode,
+		retries:       defaultRetries,
+		backupLatency: defaultBackupLatency,
+		opt:           opt,
+		clients:       make(map[string]*Client),
+		latency:       make(map[string]time.Duration),
+		idempotent:    make(map[string]bool),
+		probing:       make(map[string]bool),
+		breakers:      NewBreakerGroup(DefaultBreakerConfig),
+	}
+	// let load-aware balancers see the load of our clients
+	if s, ok := d.(interface{ SetStats(Stats) }); ok {
+		s.SetStats(xc)
+	}
+	// skip servers whose circuit breaker is open
+	if f, ok := d.(interface{ AddFilter(Filter) }); ok {
+		f.AddFilter(xc.breakers)
+	}
+	return xc
+}
+
+// SetBreakerConfig sets the config of the per-server circuit breakers,
+// nil disables them.
+func (xc *XClient) SetBreakerConfig(cfg *BreakerConfig) {
+	xc.breakers.SetConfig(cfg)
+}
+
+// BreakerStates returns the circuit breaker state of every server called so far.
+func (xc *XClient) BreakerStates() map[string]BreakerState {
+	return xc.breakers.States()
+}
+
+// SetRetries sets how many times Failover and Failtry retry a failed call.
+func (xc *XClient) SetRetries(retries int) {
+	xc.retries = retries
+}
+
+// SetBackupLatency sets how long Failbackup waits before sending the backup request.
+func (xc *XClient) SetBackupLatency(d time.Duration) {
+	xc.backupLatency = d
+}
+
+// SetHashKeyFunc sets how ConsistentHashSelect derives the hash key from a call
+// whose context carries no key set by WithHashKey.
+func (xc *XClient) SetHashKeyFunc(f HashKeyFunc) {
+	xc.hashKey = f
+}
+
+// SetIdempotent tells whether calling serviceMethod twice is harmless,
+// instead of asking a server the first time a call of it fails.
+func (xc *XClient) SetIdempotent(serviceMethod string, idempotent bool) {
+	xc.idemMu.Lock()
+	defer xc.idemMu.Unlock()
+	xc.idempotent[serviceMethod] = idempotent
+}
+
+// knownIdempotent reports whether serviceMethod is idempotent, and whether it's known yet.
+func (xc *XClient) knownIdempotent(serviceMethod string) (idempotent, known bool) {
+	xc.idemMu.Lock()
+	defer xc.idemMu.Unlock()
+	idempotent, known = xc.idempotent[serviceMethod]
+	return
+}
 
-func NewXClient(d Discovery, mode SelectMode, opt *Option) *XClient {
-	return &XClient{d: d, mode: mode, opt: opt, clients: make(map[string]*Client)}
+// isIdempotent reports whether serviceMethod is idempotent, asking the
+// Reflection service of rpcAddr within probeTimeout when it's not known yet.
+// A method which can't be described is taken as not idempotent, and when
+// the server says so, e.g. it has no Reflection service, it isn't asked again.
+func (xc *XClient) isIdempotent(ctx context.Context, rpcAddr, serviceMethod string) bool {
+	if idempotent, known := xc.knownIdempotent(serviceMethod); known {
+		return idempotent
+	}
+	client, err := xc.dial(rpcAddr)
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	var desc MethodDesc
+	args := DescribeMethodArgs{ServiceMethod: serviceMethod}
+	err = client.Call(ctx, "Reflection.DescribeMethod", args, &desc)
+	var serverErr ServerError
+	if err != nil && !errors.As(err, &serverErr) {
+		return false
+	}
+	xc.SetIdempotent(serviceMethod, err == nil && desc.Options.Idempotent)
+	return err == nil && desc.Options.Idempotent
+}
+
+// probeIdempotent asks rpcAddr whether serviceMethod is idempotent in the
+// background, for the next calls, unless it's being asked already.
+func (xc *XClient) probeIdempotent(rpcAddr, serviceMethod string) {
+	xc.idemMu.Lock()
+	defer xc.idemMu.Unlock()
+	if xc.probing[serviceMethod] {
+		return
+	}
+	xc.probing[serviceMethod] = true
+	go func() {
+		xc.isIdempotent(context.Background(), rpcAddr, serviceMethod)
+		xc.idemMu.Lock()
+		delete(xc.probing, serviceMethod)
+		xc.idemMu.Unlock()
+	}()
+}
+
+// errNoOtherServer is returned when every server was already tried by a call.
+var errNoOtherServer = errors.New("rpc client: no other server to try")
+
+// selectServer asks the discovery for a server other than the ones of except,
+// passing the hash key of the call when the discovery supports it. With a
+// discovery which can't leave servers out, errNoOtherServer is returned when
+// it hands out one of except.
+func (xc *XClient) selectServer(ctx context.Context, serviceMethod string, args interface{}, except ...string) (string, error) {
+	key := hashKeyFromContext(ctx)
+	if key == "" && xc.hashKey != nil {
+		key = xc.hashKey(serviceMethod, args)
+	}
+	if ed, ok := xc.d.(interface {
+		GetByKeyExcept(mode SelectMode, key string, except []string) (string, error)
+	}); ok {
+		rpcAddr, err := ed.GetByKeyExcept(xc.mode, key, except)
+		if err == errNoServers && len(except) > 0 {
+			err = errNoOtherServer
+		}
+		return rpcAddr, err
+	}
+	var rpcAddr string
+	var err error
+	if kd, ok := xc.d.(interface {
+		GetByKey(mode SelectMode, key string) (string, error)
+	}); ok && key != "" {
+		rpcAddr, err = kd.GetByKey(xc.mode, key)
+	} else {
+		rpcAddr, err = xc.d.Get(xc.mode)
+	}
+	for _, e := range except {
+		if err == nil && rpcAddr == e {
+			return "", errNoOtherServer
+		}
+	}
+	return rpcAddr, err
 }
 
 func (xc *XClient) Close() error {
+	// the Discovery may be shared, stop filtering it with the breakers of xc
+	if f, ok := xc.d.(interface{ RemoveFilter(Filter) }); ok {
+		f.RemoveFilter(xc.breakers)
+	}
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
 	for key, client := range xc.clients {
@@ -58,63 +251,218 @@ func (xc *XClient) dial(rpcAddr string) (*Client, error) {
 }
 
 func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	if !xc.breakers.Begin(rpcAddr) {
+		// half-open with enough trial calls in flight, or opened since it was selected
+		return notSentError{errBreakerOpen}
+	}
+	start := time.Now()
 	client, err := xc.dial(rpcAddr)
 	if err != nil {
-		return err
+		xc.breakers.Report(rpcAddr, true)
+		xc.observe(rpcAddr, time.Since(start)+failurePenalty)
+		return notSentError{err}
+	}
+	err = client.Call(ctx, serviceMethod, args, reply)
+	switch {
+	case err == nil:
+		xc.observe(rpcAddr, time.Since(start))
+	case ctx.Err() != context.Canceled:
+		xc.observe(rpcAddr, time.Since(start)+failurePenalty)
+	}
+	// a call cancelled by the caller says nothing about the server,
+	// and an error returned by the service means the server is fine
+	var serverErr ServerError
+	if err == nil || errors.As(err, &serverErr) {
+		xc.breakers.Report(rpcAddr, false)
+	} else if ctx.Err() != context.Canceled {
+		xc.breakers.Report(rpcAddr, true)
+	} else {
+		xc.breakers.Cancel(rpcAddr)
+	}
+	return err
+}
+
+// observe adds a latency sample of rpcAddr to its EWMA.
+func (xc *XClient) observe(rpcAddr string, latency time.Duration) {
+	xc.latMu.Lock()
+	defer xc.latMu.Unlock()
+	if old, ok := xc.latency[rpcAddr]; ok {
+		latency = time.Duration(latencyDecay*float64(latency) + (1-latencyDecay)*float64(old))
 	}
-	return client.Call(ctx, serviceMethod, args, reply)
+	xc.latency[rpcAddr] = latency
+}
+
+// Pending returns the number of outstanding calls on the cached client of rpcAddr.
+func (xc *XClient) Pending(rpcAddr string) int {
+	xc.mu.Lock()
+	client := xc.clients[rpcAddr]
+	xc.mu.Unlock()
+	if client == nil {
+		return 0
+	}
+	return client.NumPending()
+}
+
+// Latency returns the EWMA latency of calls to rpcAddr, failed calls count
+// failurePenalty more, 0 if unknown.
+func (xc *XClient) Latency(rpcAddr string) time.Duration {
+	xc.latMu.Lock()
+	defer xc.latMu.Unlock()
+	return xc.latency[rpcAddr]
 }
 
 // 异步调用
-func (xc *XClient) goCall(rpcAddr string, serviceMethod string, args, reply interface{}, done chan *Call) *Call {
-	// 与call逻辑类似，先获取client，然后由client.Go发起异步调用
-	// 若失败，将错误保存在call中返回
-	client, err := xc.dial(rpcAddr)
-	if err != nil {
-		call := &Call{
-			ServiceMethod: serviceMethod,
-			Error:         err,
-		}
-		if done != nil {
-			done <- call
-		}
-		return call
+func (xc *XClient) goCall(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	// 与Call逻辑相同，在后台调用Call，使失败模式、熔断器和负载均衡也适用于异步调用
+	if done == nil {
+		done = make(chan *Call, 10)
+	} else if cap(done) == 0 {
+		log.Panic("rpc client: done channel is unbuffered")
+	}
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          done,
 	}
-	return client.Go(serviceMethod, args, reply, done)
+	go func() {
+		call.Error = xc.Call(context.Background(), serviceMethod, args, reply)
+		done <- call
+	}()
+	return call
 }
 
 // Call invokes the named function, waits for it to complete,
 // and returns its error status.
-// xc will choose a proper server.
+// xc will choose a proper server, failures are handled according to its FailMode.
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	rpcAddr, err := xc.d.Get(xc.mode)
+	rpcAddr, err := xc.selectServer(ctx, serviceMethod, args)
 	if err != nil {
 		return err
 	}
-	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+	switch xc.failMode {
+	case Failover:
+		var tried []string
+		for retries := xc.retries; ; retries-- {
+			err = xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+			if !xc.retryable(ctx, err) || retries <= 0 {
+				return err
+			}
+			tried = append(tried, rpcAddr)
+			next, selectErr := xc.selectServer(ctx, serviceMethod, args, tried...)
+			if selectErr == errNoOtherServer {
+				return err
+			} else if selectErr != nil {
+				return selectErr
+			}
+			// the failed server may be gone, ask the next one about the method
+			if !xc.resendable(ctx, next, serviceMethod, err) {
+				return err
+			}
+			rpcAddr = next
+		}
+	case Failtry:
+		for retries := xc.retries; ; retries-- {
+			err = xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+			if !xc.retryable(ctx, err) || retries <= 0 || !xc.resendable(ctx, rpcAddr, serviceMethod, err) {
+				return err
+			}
+		}
+	case Failbackup:
+		return xc.backupCall(rpcAddr, ctx, serviceMethod, args, reply)
+	default: // Failfast
+		return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+	}
+}
+
+// retryable reports whether a failed call is worth sending again.
+// Errors returned by the service itself are not, the server has handled the request.
+func (xc *XClient) retryable(ctx context.Context, err error) bool {
+	var serverErr ServerError
+	return err != nil && ctx.Err() == nil && !errors.As(err, &serverErr)
+}
+
+// resendable reports whether the failed call may be sent again: it never reached
+// the server, or its method is idempotent so running it twice is harmless.
+func (xc *XClient) resendable(ctx context.Context, rpcAddr, serviceMethod string, err error) bool {
+	var notSent notSentError
+	return errors.As(err, &notSent) || xc.isIdempotent(ctx, rpcAddr, serviceMethod)
+}
+
+// backupCall sends the call to rpcAddr, and if no reply arrives within backupLatency,
+// sends the same call to another server. The first successful reply wins.
+// Both calls may run, so only methods known to be idempotent get a backup
+// request: the slow server isn't asked, the backup server is asked in the
+// background instead, and the first calls of a method get no backup.
+func (xc *XClient) backupCall(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stop the call that lost
+	type result struct {
+		reply interface{}
+		err   error
+	}
+	results := make(chan result, 2)
+	send := func(rpcAddr string) {
+		var clonedReply interface{}
+		if reply != nil {
+			clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+		}
+		err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+		results <- result{reply: clonedReply, err: err}
+	}
+
+	go send(rpcAddr)
+	inflight := 1
+	t := time.NewTimer(xc.backupLatency)
+	defer t.Stop()
+	select {
+	case r := <-results:
+		return xc.setReply(reply, r.reply, r.err)
+	case <-t.C:
+		backupAddr, err := xc.selectServer(ctx, serviceMethod, args, rpcAddr)
+		if err != nil {
+			break
+		}
+		idempotent, known := xc.knownIdempotent(serviceMethod)
+		if !known {
+			xc.probeIdempotent(backupAddr, serviceMethod)
+		}
+		if idempotent {
+			go send(backupAddr)
+			inflight++
+		}
+	}
+
+	var err error
+	for ; inflight > 0; inflight-- {
+		r := <-results
+		if r.err == nil {
+			return xc.setReply(reply, r.reply, nil)
+		}
+		err = r.err
+	}
+	return err
+}
+
+func (xc *XClient) setReply(reply, clonedReply interface{}, err error) error {
+	if err == nil && reply != nil {
+		reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
+	}
+	return err
 }
 
 // Go invokes the function asynchronously. It returns the Call structure representing
 // the invocation. The done channel will signal when the call is complete by returning
 // the same Call object. If done is nil, the channel will be allocated automatically.
 // If non-nil, done must be buffered or Go will deliberately crash.
+// Like Call, failures are handled according to the FailMode of xc.
 func (xc *XClient) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
-	rpcAddr, err := xc.d.Get(xc.mode)
-	if err != nil {
-		call := &Call{
-			ServiceMethod: serviceMethod,
-			Error:         err,
-		}
-		if done != nil {
-			done <- call
-		}
-		return call
-	}
-	return xc.goCall(rpcAddr, serviceMethod, args, reply, done)
+	return xc.goCall(serviceMethod, args, reply, done)
 }
 
 // AsyncCall invokes the function asynchronously and returns a channel that will
-// receive the result when the call completes.
+// receive the result when the call completes, failures are handled according
+// to the FailMode of xc.
 func (xc *XClient) AsyncCall(serviceMethod string, args, reply interface{}) <-chan *Call {
 	done := make(chan *Call, 10)
 	xc.Go(serviceMethod, args, reply, done)
@@ -131,6 +479,7 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 	var e error
 	replyDone := reply == nil // if reply is nil, don't need to set value
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	for _, rpcAddr := range servers {
 		wg.Add(1)
 		go func(rpcAddr string) {
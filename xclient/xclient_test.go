@@ -0,0 +1,504 @@
+package xclient
+
+import (
+	"context"
+	"fmt"
+	. "geerpc/geerpc"
+	"geerpc/registry"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Foo sleeps Foo seconds in Sleep, so servers can be made slow.
+type Foo int
+
+type Args struct{ Num1, Num2 int }
+
+func (f Foo) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func (f Foo) Sleep(args Args, reply *int) error {
+	time.Sleep(time.Second * time.Duration(f))
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func (f Foo) Fail(args Args, reply *int) error {
+	return fmt.Errorf("fail %d", args.Num1)
+}
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+// startServer starts a server serving Foo and returns its rpc address.
+func startServer(t *testing.T, foo Foo) string {
+	server := NewServer()
+	_ = server.Register(&foo)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	go server.Accept(l)
+	return "tcp@" + l.Addr().String()
+}
+
+// deadAddr returns an address nobody listens on.
+func deadAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return "tcp@" + addr
+}
+
+func TestXClient_FailMode(t *testing.T) {
+	t.Parallel()
+	alive, dead := startServer(t, 0), deadAddr(t)
+	args := Args{Num1: 1, Num2: 2}
+
+	t.Run("failfast", func(t *testing.T) {
+		xc := NewXClient(NewMultiServerDiscovery([]string{dead}), RoundRobinSelect, Failfast, nil)
+		defer func() { _ = xc.Close() }()
+		var reply int
+		err := xc.Call(context.Background(), "Foo.Sum", args, &reply)
+		_assert(err != nil, "expect a dial error")
+	})
+	t.Run("failover", func(t *testing.T) {
+		xc := NewXClient(NewMultiServerDiscovery([]string{dead, alive}), RoundRobinSelect, Failover, nil)
+		defer func() { _ = xc.Close() }()
+		for i := 0; i < 4; i++ {
+			var reply int
+			err := xc.Call(context.Background(), "Foo.Sum", args, &reply)
+			_assert(err == nil && reply == 3, "failover should reach the alive server: %v", err)
+		}
+	})
+	t.Run("failover skips the tried servers", func(t *testing.T) {
+		xc := NewXClient(NewMultiServerDiscovery([]string{dead, alive}), ConsistentHashSelect, Failover, nil)
+		defer func() { _ = xc.Close() }()
+		xc.SetBreakerConfig(nil)
+		// a key sticking to the dead server
+		var key string
+		for i := 0; key == ""; i++ {
+			if s, _ := xc.selectServer(WithHashKey(context.Background(), strconv.Itoa(i)), "Foo.Sum", args); s == dead {
+				key = strconv.Itoa(i)
+			}
+		}
+		xc.SetHashKeyFunc(func(string, interface{}) string { return key })
+		var reply int
+		err := xc.Call(context.Background(), "Foo.Sum", args, &reply)
+		_assert(err == nil && reply == 3, "failover should reach the alive server: %v", err)
+		call := <-xc.AsyncCall("Foo.Sum", args, &reply)
+		_assert(call.Error == nil, "expect async calls to fail over too: %v", call.Error)
+
+		xc = NewXClient(NewMultiServerDiscovery([]string{dead}), RoundRobinSelect, Failover, nil)
+		defer func() { _ = xc.Close() }()
+		err = xc.Call(context.Background(), "Foo.Sum", args, &reply)
+		_assert(err != nil && err != errNoOtherServer, "expect the error of the only server, got %v", err)
+	})
+	t.Run("server error is not retried", func(t *testing.T) {
+		xc := NewXClient(NewMultiServerDiscovery([]string{alive}), RoundRobinSelect, Failtry, nil)
+		defer func() { _ = xc.Close() }()
+		var reply int
+		err := xc.Call(context.Background(), "Foo.Fail", args, &reply)
+		_, ok := err.(ServerError)
+		_assert(ok && strings.Contains(err.Error(), "fail 1"), "expect the service error, got %v", err)
+	})
+	t.Run("failbackup", func(t *testing.T) {
+		slow := startServer(t, 1)
+		xc := NewXClient(NewMultiServerDiscovery([]string{slow, alive}), RoundRobinSelect, Failbackup, nil)
+		defer func() { _ = xc.Close() }()
+		xc.SetIdempotent("Foo.Sleep", true)
+		// round robin sends one of the two calls to the slow server first
+		for i := 0; i < 2; i++ {
+			var reply int
+			start := time.Now()
+			err := xc.Call(context.Background(), "Foo.Sleep", args, &reply)
+			_assert(err == nil && reply == 3, "expect a reply: %v", err)
+			_assert(time.Since(start) < time.Millisecond*500, "the backup request should win")
+		}
+	})
+}
+
+// Counter counts its calls in a counter shared by servers.
+type Counter struct{ n *int64 }
+
+func (c Counter) Slow(args Args, reply *int) error {
+	atomic.AddInt64(c.n, 1)
+	time.Sleep(time.Millisecond * 100)
+	return nil
+}
+
+// Idem is like Slow, but declared idempotent.
+func (c Counter) Idem(args Args, reply *int) error {
+	return c.Slow(args, reply)
+}
+
+func (c Counter) MethodOptions() map[string]MethodOptions {
+	return map[string]MethodOptions{"Idem": {Idempotent: true}}
+}
+
+func TestXClient_BackupIdempotent(t *testing.T) {
+	t.Parallel()
+	var n int64
+	addrs := make([]string, 2)
+	for i := range addrs {
+		server := NewServer()
+		_ = server.Register(Counter{n: &n})
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		go server.Accept(l)
+		addrs[i] = "tcp@" + l.Addr().String()
+	}
+	xc := NewXClient(NewMultiServerDiscovery(addrs), RoundRobinSelect, Failbackup, nil)
+	defer func() { _ = xc.Close() }()
+	var reply int
+	_assert(xc.Call(context.Background(), "Counter.Slow", Args{}, &reply) == nil, "expect a reply")
+	time.Sleep(time.Millisecond * 150)
+	_assert(atomic.LoadInt64(&n) == 1, "expect a method not idempotent to be called once, got %d", n)
+
+	xc.SetIdempotent("Counter.Slow", true)
+	_assert(xc.Call(context.Background(), "Counter.Slow", Args{}, &reply) == nil, "expect a reply")
+	time.Sleep(time.Millisecond * 150)
+	_assert(atomic.LoadInt64(&n) == 3, "expect an idempotent method to get a backup request, got %d", n)
+
+	// the first call learns from the backup server that Idem is idempotent
+	_assert(xc.Call(context.Background(), "Counter.Idem", Args{}, &reply) == nil, "expect a reply")
+	time.Sleep(time.Millisecond * 150)
+	_assert(atomic.LoadInt64(&n) == 4, "expect no backup request before the method is known, got %d", n)
+	_, known := xc.knownIdempotent("Counter.Idem")
+	_assert(known, "expect Idem to be probed in the background")
+	_assert(xc.Call(context.Background(), "Counter.Idem", Args{}, &reply) == nil, "expect a reply")
+	time.Sleep(time.Millisecond * 150)
+	_assert(atomic.LoadInt64(&n) == 6, "expect a backup request once Idem is known, got %d", n)
+
+	// the only server gets no backup request
+	n = 0
+	xc = NewXClient(NewMultiServerDiscovery(addrs[:1]), RandomSelect, Failbackup, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetIdempotent("Counter.Idem", true)
+	_assert(xc.Call(context.Background(), "Counter.Idem", Args{}, &reply) == nil, "expect a reply")
+	time.Sleep(time.Millisecond * 150)
+	_assert(atomic.LoadInt64(&n) == 1, "expect no backup request to the same server, got %d", n)
+
+	// an unknown method is taken as not idempotent without asking again
+	_assert(!xc.isIdempotent(context.Background(), addrs[0], "Counter.Nope"), "expect an unknown method not to be idempotent")
+	idempotent, known := xc.knownIdempotent("Counter.Nope")
+	_assert(known && !idempotent, "expect the answer of the server to be kept")
+}
+
+func TestXClient_Breaker(t *testing.T) {
+	t.Parallel()
+	alive, dead := startServer(t, 0), deadAddr(t)
+	xc := NewXClient(NewMultiServerDiscovery([]string{dead, alive}), RoundRobinSelect, Failfast, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetBreakerConfig(&BreakerConfig{ConsecutiveFailures: 2, OpenTimeout: time.Minute})
+
+	var failed int
+	for i := 0; i < 10; i++ {
+		var reply int
+		if err := xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply); err != nil {
+			failed++
+		}
+	}
+	_assert(failed == 2, "expect the dead server to be skipped after 2 failures, got %d", failed)
+	states := xc.BreakerStates()
+	_assert(states[dead] == BreakerOpen && states[alive] == BreakerClosed, "unexpected states %v", states)
+}
+
+func TestXClient_GoBookkeeping(t *testing.T) {
+	t.Parallel()
+	dead := deadAddr(t)
+	xc := NewXClient(NewMultiServerDiscovery([]string{dead}), RandomSelect, Failfast, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetBreakerConfig(&BreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Minute})
+	call := <-xc.AsyncCall("Foo.Sum", Args{Num1: 1, Num2: 2}, new(int))
+	_assert(call.Error != nil, "expect the call to a dead server to fail")
+	_assert(xc.BreakerStates()[dead] == BreakerOpen, "expect the breaker to see the async call")
+	_assert(xc.Latency(dead) >= failurePenalty, "expect the latency to count the failure, got %v", xc.Latency(dead))
+}
+
+func TestBreaker_HalfOpen(t *testing.T) {
+	b := NewBreaker(&BreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Millisecond * 10, HalfOpenSuccesses: 1})
+	b.Fail()
+	_assert(!b.Allow() && b.State() == BreakerOpen, "expect the breaker to open")
+	time.Sleep(time.Millisecond * 20)
+	_assert(b.Allow() && b.State() == BreakerHalfOpen, "expect the breaker to turn half-open")
+	b.Fail()
+	_assert(b.State() == BreakerHalfOpen, "a call sent before opening shouldn't undo the trial")
+	_assert(b.Begin() && !b.Allow() && !b.Begin(), "expect only one trial call in flight")
+	b.Fail()
+	_assert(b.State() == BreakerOpen, "a failed trial should open the breaker again")
+	time.Sleep(time.Millisecond * 20)
+	b.Success()
+	_assert(b.State() == BreakerHalfOpen, "a call sent before opening isn't a trial")
+	_assert(b.Begin(), "expect a trial call")
+	b.Cancel()
+	_assert(b.Begin(), "a cancelled trial call should free its place")
+	b.Success()
+	_assert(b.State() == BreakerClosed, "a successful trial should close the breaker")
+}
+
+func TestBreaker_HalfOpenProbes(t *testing.T) {
+	t.Parallel()
+	b := NewBreaker(&BreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Millisecond * 10, HalfOpenSuccesses: 2, HalfOpenProbes: 3})
+	b.Fail()
+	time.Sleep(time.Millisecond * 20)
+	for i := 0; i < 3; i++ {
+		_assert(b.Begin(), "expect trial call %d to be let through", i)
+	}
+	_assert(!b.Begin(), "expect at most 3 trial calls in flight")
+	b.Success()
+	_assert(b.State() == BreakerHalfOpen && b.Begin(), "expect a finished trial to free its place")
+	b.Fail()
+	_assert(b.State() == BreakerOpen && !b.Begin(), "expect the first failed trial to open the breaker again")
+	// the other trials finish after it opened
+	b.Success()
+	b.Success()
+	_assert(b.State() == BreakerOpen, "expect the breaker to stay open")
+}
+
+func TestHealthChecker(t *testing.T) {
+	t.Parallel()
+	alive, dead := startServer(t, 0), deadAddr(t)
+	d := NewMultiServerDiscovery([]string{dead, alive})
+	hc := NewHealthChecker(d, nil, &HealthCheckConfig{
+		Interval:         time.Millisecond * 10,
+		Timeout:          time.Second,
+		FailureThreshold: 1,
+		CoolDown:         time.Minute,
+	})
+	defer func() { _ = hc.Close() }()
+	time.Sleep(time.Millisecond * 100)
+
+	_, ejected := hc.Ejected()[dead]
+	_assert(ejected, "expect the dead server to be ejected")
+	for i := 0; i < 10; i++ {
+		s, err := d.Get(RoundRobinSelect)
+		_assert(err == nil && s == alive, "expect only the alive server, got %s", s)
+	}
+
+	// a server leaving the discovery is forgotten with its connection
+	hc.mu.Lock()
+	client := hc.clients[alive]
+	hc.mu.Unlock()
+	_ = d.Update([]string{dead})
+	time.Sleep(time.Millisecond * 50)
+	hc.mu.Lock()
+	_, kept := hc.clients[alive]
+	hc.mu.Unlock()
+	_assert(!kept && !client.IsAvailable(), "expect the connection to a removed server to be closed")
+	// with every server ejected, calls go to all of them
+	s, err := d.Get(RoundRobinSelect)
+	_assert(err == nil && s == dead, "expect the ejected servers when there are no others, got %q %v", s, err)
+
+	_ = hc.Close()
+	servers := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		s, _ := d.Get(RoundRobinSelect)
+		servers[s] = true
+	}
+	_assert(servers[dead], "expect a closed checker to stop filtering")
+	// a check racing with Close doesn't keep its connection
+	_assert(hc.check(alive) != nil && len(hc.clients) == 0, "expect no client to be kept after Close")
+}
+
+func TestXClient_P2CFailingServer(t *testing.T) {
+	t.Parallel()
+	// broken serves no Foo, so its calls fail fast with "can't find service"
+	broken := NewServer()
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go broken.Accept(l)
+	xc := NewXClient(NewMultiServerDiscovery([]string{startServer(t, 0), "tcp@" + l.Addr().String()}), P2CSelect, Failfast, nil)
+	defer func() { _ = xc.Close() }()
+	failed := 0
+	for i := 0; i < 50; i++ {
+		var reply int
+		if xc.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply) != nil {
+			failed++
+		}
+	}
+	_assert(failed <= 2, "expect the failing server to be avoided, got %d failures", failed)
+}
+
+func TestXClient_Idempotent(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	_ = server.SetMethodOptions("Foo.Sum", MethodOptions{Idempotent: true})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	addr := "tcp@" + l.Addr().String()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr}), RandomSelect, Failover, nil)
+	defer func() { _ = xc.Close() }()
+
+	ctx := context.Background()
+	lost := fmt.Errorf("connection lost")
+	_assert(xc.resendable(ctx, addr, "Foo.Sleep", notSentError{lost}), "expect a call never sent to be resendable")
+	_assert(xc.resendable(ctx, addr, "Foo.Sum", lost), "expect Foo.Sum to be learnt idempotent from the server")
+	_assert(!xc.resendable(ctx, addr, "Foo.Sleep", lost), "expect Foo.Sleep not to be resent")
+	xc.SetIdempotent("Foo.Sleep", true)
+	_assert(xc.resendable(ctx, addr, "Foo.Sleep", lost), "expect SetIdempotent to be honored")
+	_assert(!xc.resendable(ctx, deadAddr(t), "Foo.Fail", lost), "expect an unknown method not to be resent")
+}
+
+func TestWatchRegistryDiscovery(t *testing.T) {
+	t.Parallel()
+	var failing atomic.Bool // fail the GET requests, as if the registry were down for clients
+	r := registry.NewGeeRegistry(time.Minute)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if failing.Load() && req.Method == "GET" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+	reg := ts.URL + "/_geerpc_/registry"
+	_ = registry.Register(reg, registry.ServerItem{Addr: "tcp@a:1", Weight: 2})
+
+	d := NewWatchRegistryDiscovery(reg, time.Millisecond*20)
+	defer func() { _ = d.Close() }()
+	servers, _ := d.GetAll()
+	_assert(len(servers) == 1 && d.weights["tcp@a:1"] == 2, "expect a from the first fetch, got %v", servers)
+
+	waitFor := func(n int) []string {
+		for i := 0; i < 100; i++ {
+			if servers, _ = d.GetAll(); len(servers) == n {
+				break
+			}
+			time.Sleep(time.Millisecond * 5)
+		}
+		return servers
+	}
+	start := time.Now()
+	_ = registry.Register(reg, registry.ServerItem{Addr: "tcp@b:1"})
+	_assert(len(waitFor(2)) == 2 && time.Since(start) < time.Millisecond*200, "expect the watch to see b")
+
+	failing.Store(true)
+	_ = registry.Deregister(reg, "tcp@a:1") // wakes up the watch, which fails
+	time.Sleep(time.Millisecond * 50)
+	failing.Store(false)
+	servers = waitFor(1)
+	_assert(len(servers) == 1 && servers[0] == "tcp@b:1", "expect polling to recover, got %v", servers)
+}
+
+func TestClusterDiscovery(t *testing.T) {
+	t.Parallel()
+	r := registry.NewGeeRegistry(time.Minute)
+	live := httptest.NewServer(r)
+	defer live.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	reg := live.URL + "/_geerpc_/registry"
+	_ = registry.Register(reg, registry.ServerItem{Addr: "tcp@a:1"})
+
+	d := NewClusterDiscovery([]string{dead.URL + "/_geerpc_/registry", reg}, time.Millisecond*20)
+	defer func() { _ = d.Close() }()
+	servers, _ := d.GetAll()
+	_assert(len(servers) == 1, "expect to fail over to the live registry, got %v", servers)
+
+	_ = registry.Register(reg, registry.ServerItem{Addr: "tcp@b:1"})
+	for i := 0; i < 100; i++ {
+		if servers, _ = d.GetAll(); len(servers) == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	_assert(len(servers) == 2, "expect to watch the live registry, got %v", servers)
+
+	empty := NewClusterDiscovery(nil, 0)
+	_assert(empty.Refresh() == errNoRegistry, "expect an error without registries")
+	_, err := empty.Get(RandomSelect)
+	_assert(err != nil, "expect no servers without registries")
+	_ = empty.Close()
+}
+
+func TestRPCRegistryDiscovery(t *testing.T) {
+	t.Parallel()
+	// the registry and Foo on one port
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	_ = registry.NewGeeRegistry(time.Minute).RegisterService(server)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	addr := "tcp@" + l.Addr().String()
+
+	client, err := XDial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+	ctx := context.Background()
+	var item registry.ServerItem
+	_ = client.Call(ctx, "Registry.Register", registry.ServerItem{Addr: addr, Services: []string{"Foo"}}, &item)
+	_ = client.Call(ctx, "Registry.Register", registry.ServerItem{Addr: "tcp@other:1", Services: []string{"Bar"}}, &item)
+	_assert(client.Call(ctx, "Registry.Heartbeat", registry.HeartbeatArgs{Addr: addr}, &item) == nil &&
+		item.Addr == addr, "expect a heartbeat of a registered instance to succeed")
+	_assert(client.Call(ctx, "Registry.Heartbeat", registry.HeartbeatArgs{Addr: "tcp@unknown:1"}, &item) != nil,
+		"expect a heartbeat of an unknown instance to fail")
+
+	d := NewRPCRegistryDiscovery(addr, registry.Filter{Services: []string{"Foo"}}, time.Millisecond*20)
+	defer func() { _ = d.Close() }()
+	servers, _ := d.GetAll()
+	_assert(len(servers) == 1 && servers[0] == addr, "expect the instances offering Foo, got %v", servers)
+	xc := NewXClient(d, RandomSelect, Failfast, nil)
+	defer func() { _ = xc.Close() }()
+	var reply int
+	_assert(xc.Call(ctx, "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply) == nil && reply == 3, "expect a call through the discovery")
+
+	start := time.Now()
+	_ = client.Call(ctx, "Registry.Register", registry.ServerItem{Addr: "tcp@foo:2", Services: []string{"Foo"}}, &item)
+	for i := 0; i < 100; i++ {
+		if servers, _ = d.GetAll(); len(servers) == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	_assert(len(servers) == 2 && time.Since(start) < time.Millisecond*200, "expect the watch to see foo:2, got %v", servers)
+
+	var removed bool
+	_assert(client.Call(ctx, "Registry.Deregister", registry.DeregisterArgs{Addr: "tcp@foo:2"}, &removed) == nil && removed,
+		"expect foo:2 to be deregistered")
+	var list registry.InstanceList
+	_ = client.Call(ctx, "Registry.List", registry.Filter{}, &list)
+	_assert(len(list.Instances) == 2, "expect 2 instances left, got %v", list.Instances)
+}
+
+func TestNamespaceDiscovery(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(registry.NewGeeRegistry(time.Minute))
+	defer ts.Close()
+	reg := ts.URL + "/_geerpc_/registry"
+	_ = registry.Register(reg, registry.ServerItem{Namespace: "prod", Addr: "tcp@a:1", Services: []string{"Foo"}})
+	_ = registry.Register(reg, registry.ServerItem{Namespace: "prod", Addr: "tcp@b:1", Services: []string{"Bar"}})
+	_ = registry.Register(reg, registry.ServerItem{Namespace: "dev", Addr: "tcp@c:1", Services: []string{"Foo"}})
+	_ = registry.Register(reg, registry.ServerItem{Addr: "tcp@d:1", Services: []string{"Foo"}})
+
+	d := NewNamespaceDiscovery([]string{reg}, "prod", "Foo", time.Millisecond*20)
+	defer func() { _ = d.Close() }()
+	servers, _ := d.GetAll()
+	_assert(len(servers) == 1 && servers[0] == "tcp@a:1", "expect Foo in prod only, got %v", servers)
+
+	_ = registry.Register(reg, registry.ServerItem{Namespace: "prod", Addr: "tcp@e:1", Services: []string{"Foo"}})
+	for i := 0; i < 100; i++ {
+		if servers, _ = d.GetAll(); len(servers) == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	_assert(len(servers) == 2, "expect the watch to see e, got %v", servers)
+}